@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/andy-zhangtao/logchain/admin"
+	"github.com/docker/docker/daemon/logger"
+)
+
+// adminLockTimeout 读取未发送的日志时等待logPair.mu的最长时间, blocking模式下发送可能一直持有锁
+var adminLockTimeout = 2 * time.Second
+
+// adminAddress 解析环境变量ADMIN_ADDRESS, 未设置或者为空时不开启admin API.
+// admin API没有认证, 只能监听unix socket或者本机的TCP地址
+func adminAddress() (string, error) {
+	addr := os.Getenv("ADMIN_ADDRESS")
+	if addr == "" || strings.HasPrefix(addr, "/") {
+		return addr, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("ADMIN_ADDRESS must be a unix socket path or a loopback host:port, got %q", addr)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("ADMIN_ADDRESS must listen on a loopback address, got %q", addr)
+	}
+	return addr, nil
+}
+
+// serveAdmin 在addr上提供admin API
+func serveAdmin(lc *LogChain, addr string) {
+	var l net.Listener
+	var err error
+	if strings.HasPrefix(addr, "/") {
+		os.Remove(addr)
+		if l, err = net.Listen("unix", addr); err == nil {
+			err = os.Chmod(addr, 0600)
+		}
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		logrus.Errorf("admin: %v", err)
+		return
+	}
+	logrus.Infof("serving admin API on %s", addr)
+	if err := http.Serve(l, newAdminHandler(lc)); err != nil {
+		logrus.Errorf("admin: %v", err)
+	}
+}
+
+// adminError 带有HTTP状态码的错误
+type adminError struct {
+	code int
+	msg  string
+}
+
+func (e *adminError) Error() string {
+	return e.msg
+}
+
+func newAdminHandler(lc *LogChain) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		lc.mu.Lock()
+		containers := make([]admin.Container, 0, len(lc.idx))
+		for _, lf := range lc.idx {
+			containers = append(containers, lf.container())
+		}
+		lc.mu.Unlock()
+		writeJSON(w, containers)
+	})
+	mux.HandleFunc("/containers/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/containers/"), "/", 2)
+		lf, err := lc.lookup(parts[0])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		action := ""
+		if len(parts) == 2 {
+			action = parts[1]
+		}
+		switch action {
+		case "":
+			if allowMethod(w, r, http.MethodGet) {
+				lc.mu.Lock()
+				c := lf.container()
+				lc.mu.Unlock()
+				writeJSON(w, c)
+			}
+		case "pending":
+			if !allowMethod(w, r, http.MethodGet) {
+				return
+			}
+			p, err := lf.pendingEvents()
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(w, p)
+		case "flush":
+			if allowMethod(w, r, http.MethodPost) {
+				writeResult(w, lf.forceFlush())
+			}
+		case "pause":
+			if allowMethod(w, r, http.MethodPost) {
+				lf.pause.pause()
+				logrus.WithField("container", lf.info.ContainerID).Info("delivery paused")
+				writeResult(w, nil)
+			}
+		case "resume":
+			if allowMethod(w, r, http.MethodPost) {
+				lf.pause.resume()
+				logrus.WithField("container", lf.info.ContainerID).Info("delivery resumed")
+				writeResult(w, nil)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("/flush", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		var errs []string
+		for _, lf := range lc.pairs() {
+			if paused, _ := lf.pause.state(); paused {
+				continue
+			}
+			if err := lf.forceFlush(); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", lf.info.ContainerID, err))
+			}
+		}
+		if len(errs) > 0 {
+			writeResult(w, fmt.Errorf("flush: %s", strings.Join(errs, "; ")))
+			return
+		}
+		writeResult(w, nil)
+	})
+	mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		for _, lf := range lc.pairs() {
+			lf.pause.pause()
+		}
+		logrus.Info("delivery paused for all containers")
+		writeResult(w, nil)
+	})
+	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		for _, lf := range lc.pairs() {
+			lf.pause.resume()
+		}
+		logrus.Info("delivery resumed for all containers")
+		writeResult(w, nil)
+	})
+	mux.HandleFunc("/loglevel", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, admin.LogLevel{Level: logrus.GetLevel().String()})
+		case http.MethodPut:
+			var l admin.LogLevel
+			if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+				writeError(w, &adminError{http.StatusBadRequest, err.Error()})
+				return
+			}
+			level, err := logrus.ParseLevel(l.Level)
+			if err != nil {
+				writeError(w, &adminError{http.StatusBadRequest, err.Error()})
+				return
+			}
+			logrus.SetLevel(level)
+			logrus.Infof("log level set to %s", level)
+			writeResult(w, nil)
+		default:
+			allowMethod(w, r, http.MethodGet, http.MethodPut)
+		}
+	})
+	return mux
+}
+
+// lookup 按照容器ID, 唯一的ID前缀或者容器名查找容器
+func (lc *LogChain) lookup(ref string) (*logPair, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lf, ok := lc.idx[ref]; ok {
+		return lf, nil
+	}
+	var found *logPair
+	for id, lf := range lc.idx {
+		if lf.info.Name() == strings.TrimPrefix(ref, "/") {
+			return lf, nil
+		}
+		if ref != "" && strings.HasPrefix(id, ref) {
+			if found != nil {
+				return nil, &adminError{http.StatusBadRequest, fmt.Sprintf("container %q is ambiguous", ref)}
+			}
+			found = lf
+		}
+	}
+	if found == nil {
+		return nil, &adminError{http.StatusNotFound, fmt.Sprintf("container %q not found", ref)}
+	}
+	return found, nil
+}
+
+// pairs 返回所有正在运行的容器
+func (lc *LogChain) pairs() []*logPair {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	pairs := make([]*logPair, 0, len(lc.idx))
+	for _, lf := range lc.idx {
+		pairs = append(pairs, lf)
+	}
+	return pairs
+}
+
+// secretOptions 以这些后缀结尾的参数包含密码等, admin API中不显示它们的值. 带有目的地前缀的参数(例如es.elasticsearch-password)同样处理
+var secretOptions = []string{"-token", "-password", "-api-key", "http-headers"}
+
+// redactedValue 替代admin API中参数的值
+const redactedValue = "<redacted>"
+
+// redactOptions 复制options, 隐藏密码, token等参数的值
+func redactOptions(options map[string]string) map[string]string {
+	redacted := make(map[string]string, len(options))
+	for k, v := range options {
+		for _, suffix := range secretOptions {
+			if strings.HasSuffix(k, suffix) && v != "" {
+				v = redactedValue
+				break
+			}
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+// container 返回容器的信息, 调用者需要持有LogChain.mu
+func (lf *logPair) container() admin.Container {
+	stats := lf.stats()
+	raw, _ := json.Marshal(stats)
+	return admin.Container{
+		ID:      lf.info.ContainerID,
+		Name:    lf.info.Name(),
+		Driver:  stats.Driver,
+		Paused:  stats.Paused,
+		Options: redactOptions(lf.options),
+		Stats:   raw,
+	}
+}
+
+// pendingEvents 返回tempStr, partial片段和dedup中还没有交给driver的内容.
+// blocking模式下发送可能一直持有logPair.mu, 这里只尝试获取锁, 超过adminLockTimeout后返回错误
+func (lf *logPair) pendingEvents() (*admin.Pending, error) {
+	deadline := time.Now().Add(adminLockTimeout)
+	for !lf.mu.TryLock() {
+		if time.Now().After(deadline) {
+			return nil, &adminError{http.StatusServiceUnavailable, "container is busy delivering events, try again later"}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p := &admin.Pending{Groups: []admin.PendingGroup{}, Partials: []admin.PendingLine{}}
+	for source, g := range lf.groups {
+		if len(g.tempStr) == 0 {
+			continue
+		}
+		p.Groups = append(p.Groups, admin.PendingGroup{
+			Source: source,
+			Lines:  append([]string(nil), g.tempStr...),
+			Since:  g.opened,
+		})
+	}
+	for source, e := range lf.partials {
+		p.Partials = append(p.Partials, admin.PendingLine{Source: source, Line: string(e.Line)})
+	}
+	if lf.dedup != nil {
+		p.Repeated = lf.dedup.count
+	}
+	lf.mu.Unlock()
+
+	s := lf.stats()
+	_, p.Held = lf.pause.state()
+	if s.Buffer != nil {
+		p.Buffered = s.Buffer.Buffered
+	}
+	return p, nil
+}
+
+// forceFlush 发送tempStr和dedup中的事件, 然后发送driver缓存的batch. 暂停的容器不能flush
+func (lf *logPair) forceFlush() error {
+	if paused, _ := lf.pause.state(); paused {
+		return &adminError{http.StatusConflict, "delivery is paused, resume it first"}
+	}
+	lf.flushAll()
+	return flushBatches(lf.driver)
+}
+
+// flushBatches 沿着driver的外层找到批量发送的driver并发送缓存的batch
+func flushBatches(l logger.Logger) error {
+	switch d := l.(type) {
+	case *rateLimiter:
+		return flushBatches(d.driver)
+	case *ringLogger:
+		return flushBatches(d.driver)
+	case *pauseLogger:
+		return flushBatches(d.driver)
+	case *deliveryLogger:
+		return flushBatches(d.driver)
+	case *fanoutLogger:
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		for _, dst := range d.destinations {
+			if err := flushBatches(dst.driver); err != nil {
+				return fmt.Errorf("%s: %v", dst.name, err)
+			}
+		}
+	case batchedLogger:
+		return d.batches().Flush()
+	}
+	return nil
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, &adminError{http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method)})
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorf("admin: error writing response: %v", err)
+	}
+}
+
+// writeResult 没有返回内容的请求, 成功时返回{}
+func writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, struct{}{})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if e, ok := err.(*adminError); ok {
+		code = e.code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(admin.Error{Err: err.Error()})
+}
@@ -0,0 +1,196 @@
+// Package admin is a client for the logchain admin API. The API lists the
+// containers logging through the plugin, shows events which are not delivered
+// yet, and flushes, pauses and resumes delivery.
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultAddress is the suggested admin socket inside the plugin, the admin API
+// is disabled until ADMIN_ADDRESS is set. On the host it is
+// /run/docker/plugins/<plugin id>/admin.sock.
+const DefaultAddress = "/run/docker/plugins/admin.sock"
+
+// Container is a container logging through the plugin.
+type Container struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Driver  string            `json:"driver"`
+	Paused  bool              `json:"paused"`
+	Options map[string]string `json:"options"` // effective log-opts, including log_opt from the container env; tokens, passwords, API keys and http-headers are redacted
+	Stats   json.RawMessage   `json:"stats"`   // counters, same as the metrics of the container
+}
+
+// Pending is what a container holds and has not handed to the driver yet.
+type Pending struct {
+	Groups   []PendingGroup `json:"groups"`   // lines waiting to be grouped into an event
+	Partials []PendingLine  `json:"partials"` // partial fragments waiting for the rest of the line
+	Repeated int            `json:"repeated"` // repeated events waiting for the dedup summary
+	Held     int            `json:"held"`     // events held while delivery is paused
+	Buffered int            `json:"buffered"` // events in the non-blocking buffer
+}
+
+// PendingGroup is the lines of one stream waiting to be grouped.
+type PendingGroup struct {
+	Source string    `json:"source"`
+	Lines  []string  `json:"lines"`
+	Since  time.Time `json:"since"` // arrival of the first line
+}
+
+// PendingLine is a partial fragment of one stream.
+type PendingLine struct {
+	Source string `json:"source"`
+	Line   string `json:"line"`
+}
+
+// LogLevel is the level of the plugin's own logs.
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+// Error is the body of a failed request.
+type Error struct {
+	Err string `json:"err"`
+}
+
+// Client calls the admin API.
+type Client struct {
+	base string
+	http *http.Client
+}
+
+// NewClient creates a client for the admin API listening on addr, either
+// the path of a unix socket or a host:port.
+func NewClient(addr string) *Client {
+	if !strings.HasPrefix(addr, "/") {
+		return &Client{base: "http://" + addr, http: &http.Client{}}
+	}
+	dialer := &net.Dialer{}
+	return &Client{
+		base: "http://logchain",
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", addr)
+				},
+			},
+		},
+	}
+}
+
+// Containers lists the containers logging through the plugin.
+func (c *Client) Containers() ([]Container, error) {
+	var containers []Container
+	err := c.do(http.MethodGet, "/containers", nil, &containers)
+	return containers, err
+}
+
+// Container returns a container by ID, unique ID prefix or name.
+func (c *Client) Container(ref string) (*Container, error) {
+	var container Container
+	if err := c.do(http.MethodGet, containerPath(ref, ""), nil, &container); err != nil {
+		return nil, err
+	}
+	return &container, nil
+}
+
+// Pending returns what the container has not handed to the driver yet.
+func (c *Client) Pending(ref string) (*Pending, error) {
+	var pending Pending
+	if err := c.do(http.MethodGet, containerPath(ref, "pending"), nil, &pending); err != nil {
+		return nil, err
+	}
+	return &pending, nil
+}
+
+// Flush sends the pending events of the container and the batches of its driver.
+func (c *Client) Flush(ref string) error {
+	return c.do(http.MethodPost, containerPath(ref, "flush"), nil, nil)
+}
+
+// FlushAll flushes every container which is not paused.
+func (c *Client) FlushAll() error {
+	return c.do(http.MethodPost, "/flush", nil, nil)
+}
+
+// Pause holds the events of the container until it is resumed.
+func (c *Client) Pause(ref string) error {
+	return c.do(http.MethodPost, containerPath(ref, "pause"), nil, nil)
+}
+
+// Resume delivers the held events of the container and the following ones.
+func (c *Client) Resume(ref string) error {
+	return c.do(http.MethodPost, containerPath(ref, "resume"), nil, nil)
+}
+
+// PauseAll pauses every running container. Containers started later are not paused.
+func (c *Client) PauseAll() error {
+	return c.do(http.MethodPost, "/pause", nil, nil)
+}
+
+// ResumeAll resumes every paused container.
+func (c *Client) ResumeAll() error {
+	return c.do(http.MethodPost, "/resume", nil, nil)
+}
+
+// LogLevel returns the level of the plugin's own logs.
+func (c *Client) LogLevel() (string, error) {
+	var l LogLevel
+	err := c.do(http.MethodGet, "/loglevel", nil, &l)
+	return l.Level, err
+}
+
+// SetLogLevel changes the level of the plugin's own logs until the plugin restarts.
+func (c *Client) SetLogLevel(level string) error {
+	return c.do(http.MethodPut, "/loglevel", LogLevel{Level: level}, nil)
+}
+
+func containerPath(ref, action string) string {
+	p := "/containers/" + url.PathEscape(ref)
+	if action != "" {
+		p += "/" + action
+	}
+	return p
+}
+
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e Error
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Err == "" {
+			return fmt.Errorf("admin: %s %s: %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("admin: %s", e.Err)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
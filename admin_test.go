@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andy-zhangtao/logchain/admin"
+)
+
+// TestAdminRoundTrip 通过admin包的Client查看容器和未发送的内容, 密码等参数不显示, 容器忙时pending返回错误而不是等待
+func TestAdminRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lc := newTestLogChain()
+	lr, w := startContainer(t, lc, dir, 0, map[string]string{
+		"buf":                            "10",
+		"splunk-token":                   "00000000-0000-0000-0000-000000000000",
+		"loki-password":                  "s3cret",
+		"elasticsearch-api-key":          "a2V5",
+		"archive.elasticsearch-password": "s3cret",
+		"http-headers":                   "Authorization=Bearer abc",
+		"loki-username":                  "admin",
+	})
+	defer lc.HandlerStop(lr)
+	defer w.Close()
+
+	srv := httptest.NewServer(newAdminHandler(lc))
+	defer srv.Close()
+	c := admin.NewClient(strings.TrimPrefix(srv.URL, "http://"))
+
+	containers, err := c.Containers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 || containers[0].ID != lr.Info.ContainerID {
+		t.Fatalf("got containers %+v", containers)
+	}
+	got, err := c.Container("c0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []map[string]string{containers[0].Options, got.Options} {
+		for _, k := range []string{"splunk-token", "loki-password", "elasticsearch-api-key", "archive.elasticsearch-password", "http-headers"} {
+			if opts[k] != redactedValue {
+				t.Errorf("%s = %q, want it redacted", k, opts[k])
+			}
+		}
+		if opts["loki-username"] != "admin" || opts["buf"] != "10" {
+			t.Errorf("options redacted too much: %v", opts)
+		}
+	}
+
+	writeEntries(t, w, "waiting")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p, err := c.Pending("c0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p.Groups) == 1 && len(p.Groups[0].Lines) == 1 && p.Groups[0].Lines[0] == "waiting" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got pending %+v", p)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 发送时持有logPair.mu, pending在超时后返回错误, 释放后可以继续使用
+	defer func(d time.Duration) { adminLockTimeout = d }(adminLockTimeout)
+	adminLockTimeout = 50 * time.Millisecond
+	lf, err := lc.lookup("c0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.mu.Lock()
+	_, err = c.Pending("c0")
+	lf.mu.Unlock()
+	if err == nil || !strings.Contains(err.Error(), "busy") {
+		t.Errorf("got %v while the container is busy", err)
+	}
+
+	if err := c.Flush("c0"); err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.Pending("c0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Groups) != 0 {
+		t.Errorf("got pending %+v after flush", p)
+	}
+}
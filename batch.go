@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+)
+
+// batcher 缓存消息, 数量达到size(或者日志长度达到maxBytes)或者距离上次发送超过interval时调用flush批量发送.
+// 按数量触发的发送在Log中同步执行, flush的错误返回给调用者; 定时触发的发送只记录错误.
+// 设置了failed时发送失败的消息交给failed处理(例如写入spool), 不再返回或者记录错误
+type batcher struct {
+	mu       sync.Mutex
+	msgs     []*logger.Message
+	bytes    int
+	size     int
+	maxBytes int
+	interval time.Duration
+	flush    func([]*logger.Message) error
+	failed   func([]*logger.Message, error)
+	name     string
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// batchedLogger 使用batcher批量发送的driver
+type batchedLogger interface {
+	batches() *batcher
+}
+
+func newBatcher(name string, size int, interval time.Duration, flush func([]*logger.Message) error) *batcher {
+	if size < 1 {
+		size = 1
+	}
+	b := &batcher{
+		size:     size,
+		interval: interval,
+		flush:    flush,
+		name:     name,
+		stop:     make(chan struct{}),
+	}
+	if interval > 0 && size > 1 {
+		b.wg.Add(1)
+		go b.loop()
+	}
+	return b
+}
+
+// Add 复制msg后放入缓存, 调用者可以继续复用msg
+func (b *batcher) Add(msg *logger.Message) error {
+	m := &logger.Message{
+		Line:      append([]byte(nil), msg.Line...),
+		Source:    msg.Source,
+		Timestamp: msg.Timestamp,
+		Attrs:     msg.Attrs,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.msgs = append(b.msgs, m)
+	b.bytes += len(m.Line)
+	if len(b.msgs) < b.size && (b.maxBytes == 0 || b.bytes < b.maxBytes) {
+		return nil
+	}
+	return b.flushLocked()
+}
+
+// Flush 立即发送缓存中的消息
+func (b *batcher) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flushLocked()
+}
+
+func (b *batcher) flushLocked() error {
+	if len(b.msgs) == 0 {
+		return nil
+	}
+	msgs := b.msgs
+	b.msgs = nil
+	b.bytes = 0
+	start := time.Now()
+	err := b.flush(msgs)
+	observeDelivery(b.name, time.Since(start))
+	if err != nil && b.failed != nil {
+		for _, f := range failures(msgs, err) {
+			b.failed(f.msgs, f.err)
+		}
+		return nil
+	}
+	return err
+}
+
+func (b *batcher) loop() {
+	defer b.wg.Done()
+	t := time.NewTicker(b.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-t.C:
+			if err := b.Flush(); err != nil {
+				logrus.Errorf("%s: batch flush error: %v", b.name, err)
+			}
+		}
+	}
+}
+
+// Close 停止定时发送, 并发送缓存中剩余的消息
+func (b *batcher) Close() error {
+	close(b.stop)
+	b.wg.Wait()
+	return b.Flush()
+}
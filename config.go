@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+)
+
+// configReloadDelay 配置文件变化后等待写入完成的时间, 编辑器保存时通常会产生多个事件
+const configReloadDelay = 200 * time.Millisecond
+
+// reloadableOptions 容器运行时可以修改的参数, 只影响之后合并的日志. 其它参数在容器重新启动后生效
+var reloadableOptions = map[string]bool{
+	"buf":                 true,
+	"multiline-preset":    true,
+	"multiline-pattern":   true,
+	"multiline-negate":    true,
+	"multiline-match":     true,
+	"multiline-separator": true,
+}
+
+// reloadableList 用于日志的reloadableOptions
+var reloadableList = func() string {
+	keys := make([]string, 0, len(reloadableOptions))
+	for k := range reloadableOptions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}()
+
+// pluginConfig 插件的配置文件. defaults用于所有容器, 容器可以通过profile=<名称>使用一个profile,
+// 通过destinations=<名称>,<名称>使用命名的目标. 容器自己的log-opt优先于配置文件
+type pluginConfig struct {
+	Defaults     configProfile                `json:"defaults"`
+	Destinations map[string]configDestination `json:"destinations"`
+	Profiles     map[string]configProfile     `json:"profiles"`
+}
+
+// configProfile 一组参数以及发送的目标, 多个目标时使用fan-out
+type configProfile struct {
+	Destinations []string          `json:"destinations"`
+	Options      map[string]string `json:"options"`
+}
+
+// configDestination 一个命名的目标: driver和它的参数
+type configDestination struct {
+	Driver  string            `json:"driver"`
+	Options map[string]string `json:"options"`
+}
+
+// configFile 解析环境变量CONFIG_FILE, 未设置或者为空时不使用配置文件
+func configFile() string {
+	return os.Getenv("CONFIG_FILE")
+}
+
+// loadConfig 读取并检查配置文件, 文件不存在时返回空的配置. 只支持JSON
+func loadConfig(path string) (*pluginConfig, error) {
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		return nil, fmt.Errorf("%s: YAML is not supported, use a JSON config file", path)
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &pluginConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var c pluginConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for name, d := range c.Destinations {
+		if name == "" || strings.ContainsAny(name, ",:.") {
+			return nil, fmt.Errorf("%s: invalid destination name %q", path, name)
+		}
+		known := false
+		for _, n := range fanoutDrivers {
+			known = known || n == d.Driver
+		}
+		if !known {
+			return nil, fmt.Errorf("%s: unknown driver %q for destination %q, must be one of %s", path, d.Driver, name, strings.Join(fanoutDrivers, ", "))
+		}
+	}
+	profiles := map[string]configProfile{"defaults": c.Defaults}
+	for name, p := range c.Profiles {
+		profiles["profile "+name] = p
+	}
+	for name, p := range profiles {
+		for _, d := range p.Destinations {
+			if _, ok := c.Destinations[d]; !ok {
+				return nil, fmt.Errorf("%s: %s uses unknown destination %q", path, name, d)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// resolve 返回容器生效的参数: 依次合并defaults, profile, 目标的参数以及容器的log-opt.
+// 容器设置了driver或者drivers时不使用配置文件中的目标
+func (c *pluginConfig) resolve(opts map[string]string) (map[string]string, error) {
+	cfg := make(map[string]string)
+	for k, v := range c.Defaults.Options {
+		cfg[k] = v
+	}
+	dests := c.Defaults.Destinations
+
+	if name := opts["profile"]; name != "" {
+		p, ok := c.Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q", name)
+		}
+		for k, v := range p.Options {
+			cfg[k] = v
+		}
+		if len(p.Destinations) > 0 {
+			dests = p.Destinations
+		}
+	}
+	if v := opts["destinations"]; v != "" {
+		dests = nil
+		for _, d := range strings.Split(v, ",") {
+			if d = strings.TrimSpace(d); d == "" {
+				continue
+			}
+			if _, ok := c.Destinations[d]; !ok {
+				return nil, fmt.Errorf("unknown destination %q", d)
+			}
+			dests = append(dests, d)
+		}
+	}
+	if opts["driver"] != "" || opts["drivers"] != "" {
+		dests = nil
+	}
+
+	switch len(dests) {
+	case 0:
+	case 1:
+		d := c.Destinations[dests[0]]
+		for k, v := range d.Options {
+			cfg[k] = v
+		}
+		cfg["driver"] = d.Driver
+	default:
+		// 多个目标使用fan-out, 目标的参数放在目标名称的命名空间下
+		drivers := make([]string, 0, len(dests))
+		for _, name := range dests {
+			d := c.Destinations[name]
+			drivers = append(drivers, name+":"+d.Driver)
+			for k, v := range d.Options {
+				cfg[name+"."+k] = v
+			}
+		}
+		cfg["drivers"] = strings.Join(drivers, ",")
+		delete(cfg, "driver")
+	}
+
+	for k, v := range opts {
+		cfg[k] = v
+	}
+	return cfg, nil
+}
+
+// resolveConfig 使用当前的配置文件计算容器生效的参数
+func (lc *LogChain) resolveConfig(opts map[string]string) (map[string]string, error) {
+	lc.mu.Lock()
+	conf := lc.conf
+	lc.mu.Unlock()
+	if conf == nil {
+		return opts, nil
+	}
+	return conf.resolve(opts)
+}
+
+// watchConfig 监听配置文件所在的目录, 文件变化后重新加载. 监听目录而不是文件, 编辑器替换文件或者文件稍后创建时同样有效
+func (lc *LogChain) watchConfig(path string) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.Errorf("config: %v", err)
+		return
+	}
+	defer w.Close()
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		logrus.Errorf("config: cannot watch %s, changes need a plugin restart: %v", filepath.Dir(path), err)
+		return
+	}
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case e, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(e.Name) == filepath.Clean(path) {
+				reload = time.After(configReloadDelay)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			logrus.Errorf("config: %v", err)
+		case <-reload:
+			reload = nil
+			lc.reloadConfig(path)
+		}
+	}
+}
+
+// reloadConfig 重新加载配置文件, 之后启动的容器使用新的配置. 正在运行的容器只修改reloadableOptions中的参数,
+// 其它参数的变化对正在运行的容器忽略并记录在日志中, 在容器重新启动后生效. 配置文件有错误时继续使用原来的配置
+func (lc *LogChain) reloadConfig(path string) {
+	conf, err := loadConfig(path)
+	if err != nil {
+		logrus.Errorf("config: keeping the previous configuration: %v", err)
+		return
+	}
+
+	lc.mu.Lock()
+	lc.conf = conf
+	pairs := make([]*logPair, 0, len(lc.idx))
+	for _, lf := range lc.idx {
+		pairs = append(pairs, lf)
+	}
+	lc.mu.Unlock()
+	logrus.Infof("config: reloaded %s", path)
+
+	for _, lf := range pairs {
+		log := logrus.WithField("container", lf.info.ContainerID)
+		cfg, err := conf.resolve(lf.opts)
+		if err != nil {
+			log.Warnf("config: not applied to running container: %v", err)
+			continue
+		}
+
+		lc.mu.Lock()
+		current := lf.options
+		lc.mu.Unlock()
+
+		next := make(map[string]string, len(current))
+		for k, v := range current {
+			next[k] = v
+		}
+		var live, restart []string
+		for _, k := range changedOptions(current, cfg) {
+			if !reloadableOptions[k] {
+				restart = append(restart, k)
+				continue
+			}
+			live = append(live, k)
+			if v, ok := cfg[k]; ok {
+				next[k] = v
+			} else {
+				delete(next, k)
+			}
+		}
+		if len(restart) > 0 {
+			log.Warnf("config: %s changed, ignored until the container restarts (only %s are reloaded)", strings.Join(restart, ", "), reloadableList)
+		}
+		if len(live) == 0 {
+			continue
+		}
+		if err := lf.regroup(next); err != nil {
+			log.Errorf("config: %s not applied: %v", strings.Join(live, ", "), err)
+			continue
+		}
+		lc.mu.Lock()
+		lf.options = next
+		lc.mu.Unlock()
+		log.Infof("config: applied %s", strings.Join(live, ", "))
+	}
+}
+
+// changedOptions 返回a和b中值不同的参数
+func changedOptions(a, b map[string]string) []string {
+	var keys []string
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			keys = append(keys, k)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// regroup 按照新的参数合并之后的日志. 正在合并的事件先按照原来的规则发送
+func (lf *logPair) regroup(cfg map[string]string) error {
+	ml, err := newMultiline(cfg)
+	if err != nil {
+		return err
+	}
+	separator, err := parseSeparator(cfg)
+	if err != nil {
+		return err
+	}
+	line, err := strconv.Atoi(cfg["buf"])
+	if err != nil {
+		line = 1
+	}
+
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	for _, g := range lf.groups {
+		lf.flushLines(g)
+		g.state = 0
+	}
+	lf.ml = ml
+	lf.separator = separator
+	lf.bufLines = line
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestConfigFileOptIn 没有设置CONFIG_FILE时不使用配置文件, 文件不存在时为空的配置, 不支持YAML
+func TestConfigFileOptIn(t *testing.T) {
+	if v, ok := os.LookupEnv("CONFIG_FILE"); ok {
+		defer os.Setenv("CONFIG_FILE", v)
+	}
+	os.Unsetenv("CONFIG_FILE")
+	if got := configFile(); got != "" {
+		t.Errorf("config file %q without CONFIG_FILE", got)
+	}
+
+	dir, err := ioutil.TempDir("", "logchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf, err := loadConfig(filepath.Join(dir, "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Destinations) != 0 || len(conf.Profiles) != 0 {
+		t.Errorf("got %+v for a missing file, want an empty config", conf)
+	}
+
+	path := filepath.Join(dir, "logchain.yaml")
+	if err := ioutil.WriteFile(path, []byte("defaults: {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path); err == nil {
+		t.Error("YAML config file accepted")
+	}
+}
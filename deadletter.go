@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/go-units"
+)
+
+const defaultDeadLetterMaxSize = 100 << 20
+
+// deadLetterRecord dead-letter文件中的一行
+type deadLetterRecord struct {
+	Time          time.Time         `json:"time"`
+	Source        string            `json:"source"`
+	Line          string            `json:"line"`
+	Attrs         map[string]string `json:"attrs,omitempty"`
+	ContainerID   string            `json:"container_id"`
+	ContainerName string            `json:"container_name"`
+	Driver        string            `json:"driver"`
+	Error         string            `json:"error"`
+	Permanent     bool              `json:"permanent"`
+	FailedAt      time.Time         `json:"failed_at"`
+}
+
+// deadLetter 最终发送失败的事件写入的NDJSON文件, 每行一个事件并附带失败的原因,
+// 问题解决后可以使用logchain redeliver重新发送. 文件在第一次写入时创建, 超过maxSize后丢弃新的事件
+type deadLetter struct {
+	mu            sync.Mutex
+	path          string
+	f             *os.File
+	size          int64
+	maxSize       int64
+	containerID   string
+	containerName string
+	driver        string
+
+	written uint64
+	dropped uint64
+}
+
+// newDeadLetter 根据dead-letter和dead-letter-file参数创建dead-letter文件, 未开启时返回nil.
+// 默认文件为<STATE_DIR>/deadletter/<容器ID>/<name>.ndjson
+func newDeadLetter(info logger.Info, name string) (*deadLetter, error) {
+	cfg := info.Config
+
+	path := cfg["dead-letter-file"]
+	enabled := path != ""
+	if v, ok := cfg["dead-letter"]; ok && !enabled {
+		var err error
+		if enabled, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("dead-letter must be true or false, got %q", v)
+		}
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	d := defaultDeadLetter(info, name)
+	if path != "" {
+		d.path = path
+	}
+	if v, ok := cfg["dead-letter-max-size"]; ok {
+		size, err := units.RAMInBytes(v)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("dead-letter-max-size must be a positive size like 100m, got %q", v)
+		}
+		d.maxSize = size
+	}
+	return d, nil
+}
+
+// defaultDeadLetter 使用默认路径和大小的dead-letter文件, 也用于插件退出时保存没有开启dead-letter的事件
+func defaultDeadLetter(info logger.Info, name string) *deadLetter {
+	return &deadLetter{
+		path:          filepath.Join(stateDir(), "deadletter", info.ContainerID, name+".ndjson"),
+		maxSize:       defaultDeadLetterMaxSize,
+		containerID:   info.ContainerID,
+		containerName: info.Name(),
+		driver:        name,
+	}
+}
+
+// write 将msgs以及失败的原因写入文件
+func (d *deadLetter) write(msgs []*logger.Message, cause error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.f == nil {
+		if err := os.MkdirAll(filepath.Dir(d.path), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(d.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		d.f = f
+		d.size = fi.Size()
+		logrus.WithField("driver", d.driver).Warnf("writing failed events to dead-letter file %s", d.path)
+	}
+
+	now := time.Now().UTC()
+	for _, m := range msgs {
+		b, err := json.Marshal(&deadLetterRecord{
+			Time:          m.Timestamp,
+			Source:        m.Source,
+			Line:          string(m.Line),
+			Attrs:         m.Attrs,
+			ContainerID:   d.containerID,
+			ContainerName: d.containerName,
+			Driver:        d.driver,
+			Error:         cause.Error(),
+			Permanent:     isPermanent(cause),
+			FailedAt:      now,
+		})
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+		if d.size+int64(len(b)) > d.maxSize {
+			atomic.AddUint64(&d.dropped, 1)
+			continue
+		}
+		if _, err := d.f.Write(b); err != nil {
+			return err
+		}
+		d.size += int64(len(b))
+		atomic.AddUint64(&d.written, 1)
+	}
+	return nil
+}
+
+func (d *deadLetter) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.f == nil {
+		return nil
+	}
+	err := d.f.Close()
+	d.f = nil
+	return err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// failingLogger 没有batcher的driver, 每次Log都返回err
+type failingLogger struct {
+	mu    sync.Mutex
+	err   error
+	calls int
+}
+
+func (f *failingLogger) Log(msg *logger.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	logger.PutMessage(msg)
+	return f.err
+}
+
+func (f *failingLogger) Name() string { return "failing" }
+
+func (f *failingLogger) Close() error { return nil }
+
+// readDeadLetters 读取dead-letter文件中的记录
+func readDeadLetters(t *testing.T, path string) []deadLetterRecord {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recs []deadLetterRecord
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var rec deadLetterRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// TestDeadLetterWrite 每个事件一行, 带有容器, driver和失败的原因; 超过dead-letter-max-size后丢弃
+func TestDeadLetterWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sub", "failed.ndjson")
+	d, err := newDeadLetter(logger.Info{
+		ContainerID:   "0123456789abcdef0123456789abcdef",
+		ContainerName: "/web",
+		Config:        map[string]string{"dead-letter-file": path, "dead-letter-max-size": "1k"},
+	}, "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2024, 3, 5, 10, 0, 0, 1, time.UTC)
+	msgs := []*logger.Message{
+		{Line: []byte("first"), Source: "stdout", Timestamp: ts, Attrs: map[string]string{"team": "web"}},
+		{Line: []byte("second"), Source: "stderr", Timestamp: ts},
+	}
+	if err := d.write(msgs, permanent(errors.New("http: 400 Bad Request"))); err != nil {
+		t.Fatal(err)
+	}
+	big := &logger.Message{Line: make([]byte, 2048), Source: "stdout", Timestamp: ts}
+	if err := d.write([]*logger.Message{big}, errors.New("timeout")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recs := readDeadLetters(t, path)
+	if len(recs) != 2 {
+		t.Fatalf("got %d records, want 2", len(recs))
+	}
+	r := recs[0]
+	if r.Line != "first" || r.Source != "stdout" || !r.Time.Equal(ts) || r.Attrs["team"] != "web" ||
+		r.ContainerID != "0123456789abcdef0123456789abcdef" || r.ContainerName != "web" || r.Driver != "http" ||
+		r.Error != "http: 400 Bad Request" || !r.Permanent || r.FailedAt.IsZero() {
+		t.Errorf("unexpected record %+v", r)
+	}
+	if recs[1].Line != "second" || recs[1].Source != "stderr" {
+		t.Errorf("unexpected record %+v", recs[1])
+	}
+	if d.written != 2 || d.dropped != 1 {
+		t.Errorf("got %d written and %d dropped, want 2 and 1", d.written, d.dropped)
+	}
+}
+
+// TestDeliveryUndelivered 重试耗尽的事件写入dead-letter文件, Log返回undeliveredError, 不计入发送成功的事件
+func TestDeliveryUndelivered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "failed.ndjson")
+	f := &failingLogger{err: errors.New("connection refused")}
+	l, err := withDelivery(f, logger.Info{
+		ContainerID:   "0123456789abcdef0123456789abcdef",
+		ContainerName: "/web",
+		Config:        map[string]string{"dead-letter-file": path, "retry-max-attempts": "2", "retry-base-backoff": "1ms"},
+	}, "failing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := logger.NewMessage()
+	m.Line = []byte("lost")
+	m.Source = "stdout"
+	if err := l.Log(m); !isUndelivered(err) {
+		t.Errorf("got %v, want an undelivered error", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if f.calls != 2 {
+		t.Errorf("got %d attempts, want 2", f.calls)
+	}
+
+	var s DestinationStats
+	l.(*deliveryLogger).addStats(&s)
+	if s.Sent != 0 || s.Failed != 1 || s.DeadLettered != 1 || s.Lost != 0 {
+		t.Errorf("got stats %+v", s)
+	}
+	if recs := readDeadLetters(t, path); len(recs) != 1 || recs[0].Line != "lost" || recs[0].Permanent {
+		t.Errorf("got records %+v", recs)
+	}
+}
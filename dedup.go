@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+)
+
+// dedup 合并连续重复的事件: 第一个事件直接发送, 之后window内相同的事件只计数,
+// 遇到不同的事件或者超过window后发送一个带有repeat_count的汇总事件. 调用者需要持有logPair.mu
+type dedup struct {
+	window    time.Duration
+	normalize bool /*比较之前将数字替换为0, 忽略时间, 端口和ID的不同*/
+
+	key     string             /*正在合并的事件, 为空时没有*/
+	opened  time.Time          /*第一个事件的到达时间*/
+	last    logdriver.LogEntry /*最后一个重复的事件*/
+	attrs   map[string]string
+	count   int   /*被合并的重复事件数*/
+	firstTs int64 /*第一个事件(直接发送的事件)的时间*/
+}
+
+// newDedup 解析dedup-window和dedup-normalize, 未设置dedup-window时返回nil
+func newDedup(cfg map[string]string) (*dedup, error) {
+	window, err := parseDuration(cfg, "dedup-window")
+	if err != nil {
+		return nil, err
+	}
+	if window == 0 {
+		if _, ok := cfg["dedup-normalize"]; ok {
+			return nil, fmt.Errorf("dedup-normalize requires dedup-window")
+		}
+		return nil, nil
+	}
+
+	d := &dedup{window: window}
+	if v, ok := cfg["dedup-normalize"]; ok {
+		if d.normalize, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("dedup-normalize must be true or false, got %q", v)
+		}
+	}
+	return d, nil
+}
+
+// add 处理一个合并后的事件, 需要发送的事件交给send
+func (d *dedup) add(msg *logdriver.LogEntry, attrs map[string]string, send func(*logdriver.LogEntry, map[string]string)) {
+	key := msg.Source + "\x00" + d.normalized(msg.Line)
+	now := time.Now()
+	if key == d.key && now.Sub(d.opened) < d.window {
+		d.count++
+		d.last = *msg
+		d.attrs = attrs
+		return
+	}
+
+	d.flush(send)
+	d.key = key
+	d.opened = now
+	d.firstTs = msg.TimeNano
+	send(msg, attrs)
+}
+
+// expired 正在合并的事件超过了window
+func (d *dedup) expired(now time.Time) bool {
+	return d.key != "" && now.Sub(d.opened) >= d.window
+}
+
+// flush 发送汇总事件, 之后相同的事件重新开始合并
+func (d *dedup) flush(send func(*logdriver.LogEntry, map[string]string)) {
+	if d.count > 0 {
+		msg := d.last
+		msg.Line = []byte(fmt.Sprintf("last message repeated %d times: %s", d.count, d.last.Line))
+		attrs := make(map[string]string, len(d.attrs)+3)
+		for k, v := range d.attrs {
+			attrs[k] = v
+		}
+		attrs["repeat_count"] = strconv.Itoa(d.count)
+		attrs["repeat_first_ts"] = time.Unix(0, d.firstTs).UTC().Format(time.RFC3339Nano)
+		attrs["repeat_last_ts"] = time.Unix(0, d.last.TimeNano).UTC().Format(time.RFC3339Nano)
+		send(&msg, attrs)
+	}
+	d.key = ""
+	d.count = 0
+	d.last = logdriver.LogEntry{}
+	d.attrs = nil
+}
+
+// normalized 返回用于比较的内容, normalize时将连续的数字替换为0
+func (d *dedup) normalized(line []byte) string {
+	if !d.normalize {
+		return string(line)
+	}
+	var b bytes.Buffer
+	digits := false
+	for _, c := range line {
+		if c >= '0' && c <= '9' {
+			if !digits {
+				b.WriteByte('0')
+			}
+			digits = true
+			continue
+		}
+		digits = false
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+)
+
+// TestDedupSummary 第一个事件直接发送, 重复的事件汇总为一个带有repeat_*的事件, 时间从第一个事件开始
+func TestDedupSummary(t *testing.T) {
+	d, err := newDedup(map[string]string{"dedup-window": "1m", "dedup-normalize": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	var attrs []map[string]string
+	send := func(msg *logdriver.LogEntry, a map[string]string) {
+		lines = append(lines, string(msg.Line))
+		attrs = append(attrs, a)
+	}
+
+	start := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	for i, line := range []string{"connect 10.0.0.1:5432 refused", "connect 10.0.0.1:5433 refused", "connect 10.0.0.1:5434 refused", "ok"} {
+		d.add(&logdriver.LogEntry{Source: "stderr", Line: []byte(line), TimeNano: start.Add(time.Duration(i) * time.Second).UnixNano()}, map[string]string{"line_count": "1"}, send)
+	}
+	d.flush(send)
+
+	want := []string{"connect 10.0.0.1:5432 refused", "last message repeated 2 times: connect 10.0.0.1:5434 refused", "ok"}
+	if len(lines) != len(want) {
+		t.Fatalf("got events %q, want %q", lines, want)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("event %d: got %q, want %q", i, lines[i], want[i])
+		}
+	}
+	for k, v := range map[string]string{
+		"repeat_count":    "2",
+		"repeat_first_ts": "2024-03-05T10:00:00Z",
+		"repeat_last_ts":  "2024-03-05T10:00:02Z",
+		"line_count":      "1",
+	} {
+		if attrs[1][k] != v {
+			t.Errorf("summary %s = %q, want %q", k, attrs[1][k], v)
+		}
+	}
+	if _, ok := attrs[2]["repeat_count"]; ok {
+		t.Errorf("unexpected summary attrs on a new event: %v", attrs[2])
+	}
+}
+
+// TestDedupWindow 超过window后发送汇总事件, 之后相同的事件重新开始
+func TestDedupWindow(t *testing.T) {
+	d, err := newDedup(map[string]string{"dedup-window": "50ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	send := func(msg *logdriver.LogEntry, a map[string]string) {
+		lines = append(lines, string(msg.Line))
+	}
+	msg := func() *logdriver.LogEntry {
+		return &logdriver.LogEntry{Source: "stdout", Line: []byte("same"), TimeNano: time.Now().UnixNano()}
+	}
+
+	d.add(msg(), nil, send)
+	d.add(msg(), nil, send)
+	if d.expired(time.Now()) {
+		t.Fatal("expired before the window")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !d.expired(time.Now()) {
+		t.Fatal("not expired after the window")
+	}
+	d.flush(send)
+	d.add(msg(), nil, send)
+
+	want := []string{"same", "last message repeated 1 times: same", "same"}
+	if len(lines) != len(want) {
+		t.Fatalf("got events %q, want %q", lines, want)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("event %d: got %q, want %q", i, lines[i], want[i])
+		}
+	}
+}
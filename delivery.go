@@ -0,0 +1,285 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/daemon/logger/jsonfilelog"
+)
+
+const (
+	defaultDeliveryRetry = 2
+	deliveryRetryBackoff = 200 * time.Millisecond
+)
+
+// deliveryLogger 处理driver发送失败的事件. 没有batcher的driver在这里按照重试策略重试,
+// 批量发送的driver在自己的send中重试. 重试耗尽的事件写入spool, 目标恢复后按顺序重新发送(at-least-once);
+// 不可重试的事件, 以及没有开启spool时重试耗尽的事件写入dead-letter文件.
+// spool中有未发送的事件时, 新的事件也写入spool, 保证发送顺序
+type deliveryLogger struct {
+	driver   logger.Logger
+	send     func([]*logger.Message) error
+	retry    *retryPolicy
+	spool    *spool
+	dead     *deadLetter
+	fallback *deadLetter /*没有开启dead-letter时, 插件退出过程中失败的事件写入默认的dead-letter文件*/
+	stop     chan struct{}
+	done     chan struct{}
+
+	delivered uint64 /*发送成功的事件*/
+	failed    uint64 /*重试之后仍然失败的事件*/
+	lost      uint64 /*没有spool和dead-letter时丢弃的事件*/
+}
+
+// withDelivery 为driver添加重试, spool和dead-letter. 本地jsonfile不需要处理, fan-out的每个目标单独处理.
+// name 区分同一个容器的多个目标
+func withDelivery(l logger.Logger, info logger.Info, name string) (logger.Logger, error) {
+	if l.Name() == jsonfilelog.Name || l.Name() == fanoutName {
+		return l, nil
+	}
+
+	retry, err := newRetryPolicy(info.Config, "", defaultDeliveryRetry, deliveryRetryBackoff)
+	if err != nil {
+		return nil, err
+	}
+	dead, err := newDeadLetter(info, name)
+	if err != nil {
+		return nil, err
+	}
+	sp, err := newSpool(info, name)
+	if err != nil {
+		if dead != nil {
+			dead.close()
+		}
+		return nil, err
+	}
+
+	d := &deliveryLogger{
+		driver: l,
+		retry:  retry,
+		spool:  sp,
+		dead:   dead,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if dead == nil {
+		d.fallback = defaultDeadLetter(info, name)
+	}
+
+	// 批量发送的driver在batcher发送失败时交给fail处理, 重新发送时直接调用batcher的flush
+	if b, ok := l.(batchedLogger); ok {
+		flush := b.batches().flush
+		b.batches().flush = func(msgs []*logger.Message) error {
+			err := flush(msgs)
+			atomic.AddUint64(&d.delivered, uint64(len(msgs)-failedCount(msgs, err)))
+			return err
+		}
+		d.send = b.batches().flush
+		b.batches().failed = d.fail
+	} else {
+		d.send = d.logAll
+	}
+
+	if sp != nil {
+		go d.replay()
+	} else {
+		close(d.done)
+	}
+	return d, nil
+}
+
+// undeliveredError Log在重试之后仍然失败, 事件已经写入spool, dead-letter文件或者被丢弃, 调用者只需要计数
+type undeliveredError struct {
+	err error
+}
+
+func (e *undeliveredError) Error() string {
+	return e.err.Error()
+}
+
+func isUndelivered(err error) bool {
+	_, ok := err.(*undeliveredError)
+	return ok
+}
+
+func copyMessage(msg *logger.Message) *logger.Message {
+	return &logger.Message{
+		Line:      append([]byte(nil), msg.Line...),
+		Source:    msg.Source,
+		Timestamp: msg.Timestamp,
+		Attrs:     msg.Attrs,
+	}
+}
+
+func (d *deliveryLogger) Log(msg *logger.Message) error {
+	if d.spool != nil && !d.spool.empty() {
+		m := copyMessage(msg)
+		logger.PutMessage(msg)
+		return d.spool.append([]*logger.Message{m})
+	}
+
+	if _, ok := d.driver.(batchedLogger); ok {
+		return d.driver.Log(msg)
+	}
+
+	// driver.Log会回收msg, 每次重试都需要复制
+	m := copyMessage(msg)
+	logger.PutMessage(msg)
+	start := time.Now()
+	err := d.retry.do(d.driver.Name(), func() error {
+		return d.driver.Log(copyMessage(m))
+	})
+	observeDelivery(d.driver.Name(), time.Since(start))
+	if err != nil {
+		d.fail([]*logger.Message{m}, err)
+		return &undeliveredError{err: err}
+	}
+	atomic.AddUint64(&d.delivered, 1)
+	return nil
+}
+
+// logAll 逐条发送, 用于重新发送spool中的事件
+func (d *deliveryLogger) logAll(msgs []*logger.Message) error {
+	for _, m := range msgs {
+		if err := d.driver.Log(m); err != nil {
+			return err
+		}
+		atomic.AddUint64(&d.delivered, 1)
+	}
+	return nil
+}
+
+// failedCount 返回msgs中因为err发送失败的事件数
+func failedCount(msgs []*logger.Message, err error) int {
+	if err == nil {
+		return 0
+	}
+	n := 0
+	for _, f := range failures(msgs, err) {
+		n += len(f.msgs)
+	}
+	return n
+}
+
+// fail 处理最终发送失败的事件: 可以重试的写入spool, 其它的写入dead-letter文件
+func (d *deliveryLogger) fail(msgs []*logger.Message, err error) {
+	log := logrus.WithField("driver", d.driver.Name())
+	atomic.AddUint64(&d.failed, uint64(len(msgs)))
+
+	if d.spool != nil && !isPermanent(err) {
+		if d.spool.empty() {
+			log.Warnf("delivery failed, spooling events to disk: %v", err)
+		}
+		if err := d.spool.append(msgs); err != nil {
+			log.Errorf("error writing spool: %v", err)
+		}
+		return
+	}
+
+	dead := d.dead
+	if dead == nil && isShuttingDown() {
+		dead = d.fallback
+	}
+	if dead != nil {
+		derr := dead.write(msgs, err)
+		if derr == nil {
+			return
+		}
+		log.Errorf("error writing dead-letter file: %v", derr)
+	}
+	atomic.AddUint64(&d.lost, uint64(len(msgs)))
+	log.Errorf("dropping %d events: %v", len(msgs), err)
+}
+
+// replay 每隔spool.retry重新发送spool中的事件, 直到spool为空或者再次失败.
+// 部分事件失败或者不可重试的错误不会阻塞spool, 失败的事件交给fail处理
+func (d *deliveryLogger) replay() {
+	defer close(d.done)
+	t := time.NewTicker(d.spool.retry)
+	defer t.Stop()
+	log := logrus.WithField("driver", d.driver.Name())
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-t.C:
+		}
+
+		for !d.spool.empty() {
+			select {
+			case <-d.stop:
+				return
+			default:
+			}
+			msgs, pos, err := d.spool.read(spoolReplayBatch)
+			if err != nil {
+				log.Errorf("error reading spool: %v", err)
+				break
+			}
+			if len(msgs) == 0 {
+				// 记录无法读取(例如segment被外部修改), 等待下一次重试
+				break
+			}
+			serr := d.send(msgs)
+			if _, partial := serr.(*partialError); serr != nil && !partial && !isPermanent(serr) {
+				break
+			}
+			if err := d.spool.ack(pos, len(msgs)); err != nil {
+				log.Errorf("error updating spool: %v", err)
+				break
+			}
+			if serr != nil {
+				for _, f := range failures(msgs, serr) {
+					d.fail(f.msgs, f.err)
+				}
+			}
+			if d.spool.empty() {
+				log.Info("spool drained, destination recovered")
+			}
+		}
+	}
+}
+
+// Close 停止重新发送并关闭driver, 关闭时发送失败的事件仍然写入spool或者dead-letter文件
+func (d *deliveryLogger) Close() error {
+	close(d.stop)
+	<-d.done
+	err := d.driver.Close()
+	if d.spool != nil {
+		if cerr := d.spool.close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for _, dead := range []*deadLetter{d.dead, d.fallback} {
+		if dead == nil {
+			continue
+		}
+		if cerr := dead.close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// addStats 将发送成功和重试之后失败的事件数, spool和dead-letter的统计加入s.
+// 批量发送的driver在Log之后才发送, 所以使用这里的统计而不是调用者的计数
+func (d *deliveryLogger) addStats(s *DestinationStats) {
+	s.Sent = atomic.LoadUint64(&d.delivered)
+	s.Failed = atomic.LoadUint64(&d.failed)
+	s.Lost = atomic.LoadUint64(&d.lost)
+	for _, dead := range []*deadLetter{d.dead, d.fallback} {
+		if dead != nil {
+			s.DeadLettered += atomic.LoadUint64(&dead.written)
+		}
+	}
+	if d.spool != nil {
+		sp := d.spool.stats()
+		s.Spool = &sp
+	}
+}
+
+func (d *deliveryLogger) Name() string {
+	return d.driver.Name()
+}
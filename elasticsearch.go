@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	elasticsearchName          = "elasticsearch"
+	defaultElasticsearchIndex  = "logs-{{.ContainerName}}-2006.01.02"
+	defaultElasticsearchBatch  = 500
+	defaultElasticsearchBytes  = 5 << 20
+	defaultElasticsearchRetry  = 3
+	elasticsearchRetryInterval = 200 * time.Millisecond
+)
+
+// elasticsearchLogger 通过_bulk接口批量写入Elasticsearch/OpenSearch.
+// bulk响应中429和5xx的文档按照重试策略重新发送, 其它被拒绝的文档作为不可重试的错误返回
+type elasticsearchLogger struct {
+	mu       sync.Mutex
+	client   *http.Client
+	urls     []string
+	next     int
+	index    *nameTemplate
+	username string
+	password string
+	apiKey   string
+	hostname string
+	extra    map[string]interface{}
+	retry    *retryPolicy
+	batch    *batcher
+}
+
+// bulkResponse _bulk接口的响应, 只解析需要的字段
+type bulkResponse struct {
+	Errors bool                        `json:"errors"`
+	Items  []map[string]bulkItemResult `json:"items"`
+}
+
+type bulkItemResult struct {
+	Status int `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// NewElasticsearch creates an elasticsearch logger. The supported log opts are
+// elasticsearch-url, elasticsearch-index, elasticsearch-username, elasticsearch-password,
+// elasticsearch-api-key, elasticsearch-batch-size, elasticsearch-batch-bytes,
+// elasticsearch-flush-interval, elasticsearch-max-retries and the http client options.
+func NewElasticsearch(info logger.Info) (logger.Logger, error) {
+	cfg := info.Config
+
+	if cfg["elasticsearch-url"] == "" {
+		return nil, fmt.Errorf("elasticsearch: elasticsearch-url is a required parameter")
+	}
+
+	var urls []string
+	for _, u := range strings.Split(cfg["elasticsearch-url"], ",") {
+		u = strings.TrimRight(strings.TrimSpace(u), "/")
+		if _, err := url.ParseRequestURI(u); err != nil {
+			return nil, fmt.Errorf("elasticsearch: invalid elasticsearch-url %q: %v", u, err)
+		}
+		urls = append(urls, u)
+	}
+
+	tmpl := cfg["elasticsearch-index"]
+	if tmpl == "" {
+		tmpl = defaultElasticsearchIndex
+	}
+	index, err := newNameTemplate(tmpl, info)
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch: %v", err)
+	}
+
+	client, err := newHTTPClient(cfg, elasticsearchName)
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch: %v", err)
+	}
+
+	hostname, err := info.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch: cannot access hostname: %v", err)
+	}
+
+	extra, err := containerExtra(info, "")
+	if err != nil {
+		return nil, err
+	}
+
+	e := &elasticsearchLogger{
+		client:   client,
+		urls:     urls,
+		index:    index,
+		username: cfg["elasticsearch-username"],
+		password: cfg["elasticsearch-password"],
+		apiKey:   cfg["elasticsearch-api-key"],
+		hostname: hostname,
+		extra:    extra,
+	}
+
+	if e.retry, err = newRetryPolicy(cfg, elasticsearchName, defaultElasticsearchRetry, elasticsearchRetryInterval); err != nil {
+		return nil, fmt.Errorf("elasticsearch: %v", err)
+	}
+
+	size, err := parseInt(cfg, "elasticsearch-batch-size", defaultElasticsearchBatch)
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch: %v", err)
+	}
+	maxBytes, err := parseInt(cfg, "elasticsearch-batch-bytes", defaultElasticsearchBytes)
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch: %v", err)
+	}
+	interval, err := parseDuration(cfg, "elasticsearch-flush-interval")
+	if err != nil {
+		return nil, err
+	}
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	e.batch = newBatcher(elasticsearchName, size, interval, e.send)
+	e.batch.maxBytes = maxBytes
+	return e, nil
+}
+
+func (e *elasticsearchLogger) Log(msg *logger.Message) error {
+	err := e.batch.Add(msg)
+	logger.PutMessage(msg)
+	return err
+}
+
+// send 通过_bulk发送一批文档, 429和5xx的文档按照重试策略重试.
+// 只有部分文档失败时返回partialError, 每个被拒绝的文档带有各自的原因
+func (e *elasticsearchLogger) send(msgs []*logger.Message) error {
+	docs := make([][]byte, 0, len(msgs))
+	for _, m := range msgs {
+		doc, err := e.document(m)
+		if err != nil {
+			return permanent(fmt.Errorf("elasticsearch: %v", err))
+		}
+		docs = append(docs, doc)
+	}
+
+	var failed []deliveryFailure
+	pending := make([]int, len(docs))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	err := e.retry.do(elasticsearchName, func() error {
+		batch := make([][]byte, len(pending))
+		for i, p := range pending {
+			batch[i] = docs[p]
+		}
+		retry, rejected, err := e.bulk(batch)
+		if err != nil {
+			return err
+		}
+
+		for i, reason := range rejected {
+			failed = append(failed, deliveryFailure{
+				msgs: []*logger.Message{msgs[pending[i]]},
+				err:  permanent(fmt.Errorf("elasticsearch: document rejected: %s", reason)),
+			})
+		}
+		next := make([]int, 0, len(retry))
+		for _, i := range retry {
+			next = append(next, pending[i])
+		}
+		pending = next
+		if len(pending) > 0 {
+			return fmt.Errorf("%d documents failed", len(pending))
+		}
+		return nil
+	})
+
+	if err != nil {
+		if len(failed) == 0 && len(pending) == len(msgs) {
+			return err
+		}
+		rest := make([]*logger.Message, 0, len(pending))
+		for _, i := range pending {
+			rest = append(rest, msgs[i])
+		}
+		failed = append(failed, deliveryFailure{msgs: rest, err: err})
+	}
+	if len(failed) > 0 {
+		return &partialError{failures: failed}
+	}
+	return nil
+}
+
+// document 生成bulk请求中一个文档的action和source两行
+func (e *elasticsearchLogger) document(msg *logger.Message) ([]byte, error) {
+	action, err := json.Marshal(map[string]interface{}{
+		"index": map[string]string{"_index": strings.ToLower(e.index.Name(msg.Timestamp))},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	source := make(map[string]interface{}, len(e.extra)+len(msg.Attrs)+4)
+	for k, v := range e.extra {
+		source[k] = v
+	}
+	for k, v := range msg.Attrs {
+		source[k] = v
+	}
+	source["@timestamp"] = msg.Timestamp.UTC().Format(time.RFC3339Nano)
+	source["message"] = string(msg.Line)
+	source["source"] = msg.Source
+	source["host"] = e.hostname
+
+	body, err := json.Marshal(source)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := make([]byte, 0, len(action)+len(body)+2)
+	doc = append(doc, action...)
+	doc = append(doc, '\n')
+	doc = append(doc, body...)
+	return append(doc, '\n'), nil
+}
+
+// bulk 发送一次_bulk请求. 返回需要重试的文档的下标以及被拒绝的文档的下标和原因;
+// 整个请求失败时返回err, 网络错误, 429和5xx可以重试, 其它状态码不可重试
+func (e *elasticsearchLogger) bulk(docs [][]byte) ([]int, map[int]string, error) {
+	req, err := http.NewRequest("POST", e.url()+"/_bulk", bytes.NewReader(bytes.Join(docs, nil)))
+	if err != nil {
+		return nil, nil, permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if e.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+e.apiKey)
+	} else if e.username != "" {
+		req.SetBasicAuth(e.username, e.password)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, nil, fmt.Errorf("bulk request failed with status %d", resp.StatusCode)
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, nil, permanent(fmt.Errorf("bulk request failed with status %d: %s", resp.StatusCode, body))
+	}
+
+	var result bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, nil, fmt.Errorf("cannot decode bulk response: %v", err)
+	}
+	if !result.Errors {
+		return nil, nil, nil
+	}
+
+	var retry []int
+	rejected := make(map[int]string)
+	for i, item := range result.Items {
+		if i >= len(docs) {
+			break
+		}
+		for _, r := range item {
+			switch {
+			case r.Status == http.StatusTooManyRequests || r.Status >= 500:
+				retry = append(retry, i)
+			case r.Status >= 300:
+				reason := fmt.Sprintf("status %d", r.Status)
+				if r.Error != nil {
+					reason = fmt.Sprintf("%s: %s", r.Error.Type, r.Error.Reason)
+				}
+				rejected[i] = reason
+			}
+		}
+	}
+	return retry, rejected, nil
+}
+
+// url 轮流使用配置的多个地址
+func (e *elasticsearchLogger) url() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	u := e.urls[e.next%len(e.urls)]
+	e.next++
+	return u
+}
+
+func (e *elasticsearchLogger) Close() error {
+	return e.batch.Close()
+}
+
+func (e *elasticsearchLogger) batches() *batcher {
+	return e.batch
+}
+
+func (e *elasticsearchLogger) Name() string {
+	return elasticsearchName
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// bulkDoc bulk请求中的一个文档
+type bulkDoc struct {
+	index   string
+	message string
+}
+
+// TestElasticsearchPartialBulk bulk响应errors:true时, 400的文档被拒绝, 429的文档单独重试, 201的文档不再发送
+func TestElasticsearchPartialBulk(t *testing.T) {
+	var mu sync.Mutex
+	var requests [][]bulkDoc
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("unexpected request %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var docs []bulkDoc
+		s := bufio.NewScanner(r.Body)
+		for s.Scan() {
+			var action struct {
+				Index struct {
+					Index string `json:"_index"`
+				} `json:"index"`
+			}
+			var source struct {
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal(s.Bytes(), &action); err != nil || !s.Scan() {
+				t.Errorf("invalid action %q", s.Text())
+				return
+			}
+			if err := json.Unmarshal(s.Bytes(), &source); err != nil {
+				t.Errorf("invalid source %q", s.Text())
+				return
+			}
+			docs = append(docs, bulkDoc{action.Index.Index, source.Message})
+		}
+
+		mu.Lock()
+		requests = append(requests, docs)
+		first := len(requests) == 1
+		mu.Unlock()
+
+		if !first {
+			fmt.Fprint(w, `{"errors":false,"items":[{"index":{"status":201}}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"errors":true,"items":[
+			{"index":{"status":201}},
+			{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse field [level]"}}},
+			{"index":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue is full"}}},
+			{"index":{"status":201}}]}`)
+	}))
+	defer srv.Close()
+
+	l, err := NewElasticsearch(logger.Info{
+		ContainerID:   "0123456789abcdef0123456789abcdef",
+		ContainerName: "/Web",
+		Config: map[string]string{
+			"elasticsearch-url":   srv.URL,
+			"elasticsearch-index": "logs-{{.ContainerName}}-2006.01.02",
+			"retry-base-backoff":  "1ms",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := l.(*elasticsearchLogger)
+	defer e.Close()
+
+	day := time.Date(2024, 3, 5, 23, 30, 0, 0, time.UTC)
+	var msgs []*logger.Message
+	for i, line := range []string{"ok", "bad", "busy", "next day"} {
+		ts := day
+		if i == 3 {
+			ts = day.Add(time.Hour)
+		}
+		msgs = append(msgs, &logger.Message{Line: []byte(line), Source: "stdout", Timestamp: ts})
+	}
+
+	err = e.send(msgs)
+	pe, ok := err.(*partialError)
+	if !ok {
+		t.Fatalf("got %v, want a partialError", err)
+	}
+	if len(pe.failures) != 1 || len(pe.failures[0].msgs) != 1 || string(pe.failures[0].msgs[0].Line) != "bad" {
+		t.Fatalf("unexpected failures %v", pe)
+	}
+	if !isPermanent(pe.failures[0].err) || !strings.Contains(pe.failures[0].err.Error(), "mapper_parsing_exception") {
+		t.Errorf("unexpected failure %v", pe.failures[0].err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := [][]bulkDoc{
+		{
+			{"logs-web-2024.03.05", "ok"},
+			{"logs-web-2024.03.05", "bad"},
+			{"logs-web-2024.03.05", "busy"},
+			{"logs-web-2024.03.06", "next day"},
+		},
+		{
+			{"logs-web-2024.03.05", "busy"},
+		},
+	}
+	if fmt.Sprint(requests) != fmt.Sprint(want) {
+		t.Errorf("got requests %v, want %v", requests, want)
+	}
+}
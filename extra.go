@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/daemon/logger/loggerutils"
+)
+
+// containerExtra 返回容器的元数据, 所有driver都会将其附加到日志中.
+// prefix 字段名的前缀, 例如GELF要求附加字段以_开头
+func containerExtra(info logger.Info, prefix string) (map[string]interface{}, error) {
+	// parse log tag
+	tag, err := loggerutils.ParseLogTag(info, loggerutils.DefaultTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	extra := map[string]interface{}{
+		prefix + "container_id":   info.ContainerID,
+		prefix + "container_name": info.Name(),
+		prefix + "image_id":       info.ContainerImageID,
+		prefix + "image_name":     info.ContainerImageName,
+		prefix + "command":        info.Command(),
+		prefix + "tag":            tag,
+		prefix + "created":        info.ContainerCreated,
+	}
+
+	extraAttrs, err := info.ExtraAttributes(func(key string) string {
+		if prefix == "" || strings.HasPrefix(key, prefix) {
+			return key
+		}
+		return prefix + key
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range extraAttrs {
+		extra[k] = v
+	}
+
+	return extra, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	fanoutName       = "fanout"
+	defaultQueueSize = 1000
+)
+
+// fanoutDrivers 可以作为fan-out目标的driver. 本地的json文件总是会写入, 所以不能作为目标
+var fanoutDrivers = []string{"graylog", "fluentd", "syslog", "elasticsearch", "loki", "kafka", "http", "splunk"}
+
+// fanoutLogger 将同一个事件发送给多个driver, 例如drivers=graylog,http.
+// 每个目标有自己的队列和goroutine, 一个目标变慢或者失败不会影响其它目标; 队列满时丢弃该目标的事件
+type fanoutLogger struct {
+	mu           sync.RWMutex
+	closed       bool
+	destinations []*destination
+}
+
+// destination fan-out的一个目标
+type destination struct {
+	name   string
+	driver logger.Logger
+	queue  chan *logger.Message
+	done   chan struct{}
+
+	sent    uint64
+	failed  uint64
+	dropped uint64
+}
+
+// DestinationStats 一个目标的发送统计
+type DestinationStats struct {
+	Name    string `json:"name"`
+	Driver  string `json:"driver"`
+	Sent    uint64 `json:"sent"`
+	Failed  uint64 `json:"failed"`
+	Dropped uint64 `json:"dropped"`
+	Queued  int    `json:"queued"`
+
+	Lost         uint64      `json:"lost"`
+	DeadLettered uint64      `json:"dead_lettered"`
+	Spool        *SpoolStats `json:"spool,omitempty"`
+}
+
+// NewFanout creates a logger which sends every event to all destinations in drivers.
+// Each destination is written as name or name:driver, e.g. drivers=graylog,archive:http.
+// Options of a destination are namespaced by its name, e.g. archive.http-url; options
+// without a namespace are shared by all destinations. queue-size sets the length of
+// each destination queue. Options whose prefix before the first "." is not a destination
+// name, e.g. labels of other tools, are shared like options without a namespace.
+func NewFanout(info logger.Info) (logger.Logger, error) {
+	var names, drivers []string
+	seen := make(map[string]bool)
+	for _, d := range strings.Split(info.Config["drivers"], ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		name, driver := d, d
+		if i := strings.Index(d, ":"); i >= 0 {
+			name, driver = d[:i], d[i+1:]
+		}
+		if name == "" || strings.Contains(name, ".") {
+			return nil, fmt.Errorf("fanout: invalid destination name %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("fanout: duplicate destination %q", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+		drivers = append(drivers, strings.ToLower(driver))
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("fanout: drivers must contain at least one driver")
+	}
+
+	f := &fanoutLogger{}
+	for i, name := range names {
+		dst, err := newDestination(info, name, drivers[i], seen)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.destinations = append(f.destinations, dst)
+	}
+	return f, nil
+}
+
+// newDestination 使用name命名空间下的参数创建目标的driver, names为所有目标的名称
+func newDestination(info logger.Info, name, driver string, names map[string]bool) (*destination, error) {
+	known := false
+	for _, n := range fanoutDrivers {
+		known = known || n == driver
+	}
+	if !known {
+		return nil, fmt.Errorf("fanout: unknown driver %q for destination %q, must be one of %s", driver, name, strings.Join(fanoutDrivers, ", "))
+	}
+
+	info.Config = destinationConfig(info.Config, name, names)
+	info.Config["driver"] = driver
+	delete(info.Config, "drivers")
+
+	size, err := parseInt(info.Config, "queue-size", defaultQueueSize)
+	if err != nil {
+		return nil, fmt.Errorf("fanout: %s: %v", name, err)
+	}
+
+	l, err := New(info)
+	if err != nil {
+		return nil, fmt.Errorf("fanout: %s: %v", name, err)
+	}
+	dl, err := withDelivery(l, info, name)
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("fanout: %s: %v", name, err)
+	}
+
+	d := &destination{
+		name:   name,
+		driver: dl,
+		queue:  make(chan *logger.Message, size),
+		done:   make(chan struct{}),
+	}
+	go d.loop()
+	return d, nil
+}
+
+// destinationConfig 返回目标name的参数: 不属于任何目标的参数加上name.开头的参数(去掉前缀),
+// 其它目标的参数会被去掉. names为所有目标的名称, 前缀不是目标名称的参数(例如标签名)不是命名空间
+func destinationConfig(cfg map[string]string, name string, names map[string]bool) map[string]string {
+	c := make(map[string]string, len(cfg))
+	for k, v := range cfg {
+		if i := strings.Index(k, "."); i < 0 || !names[k[:i]] {
+			c[k] = v
+		}
+	}
+	prefix := name + "."
+	for k, v := range cfg {
+		if strings.HasPrefix(k, prefix) {
+			c[strings.TrimPrefix(k, prefix)] = v
+		}
+	}
+	return c
+}
+
+func (d *destination) loop() {
+	defer close(d.done)
+	for msg := range d.queue {
+		if err := d.driver.Log(msg); err != nil {
+			if atomic.AddUint64(&d.failed, 1) == 1 {
+				logrus.WithField("destination", d.name).Errorf("error sending log: %v", err)
+			}
+			continue
+		}
+		atomic.AddUint64(&d.sent, 1)
+	}
+}
+
+// Log 复制msg后放入每个目标的队列, 不会阻塞
+func (f *fanoutLogger) Log(msg *logger.Message) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return fmt.Errorf("fanout: logger is closed")
+	}
+
+	for _, d := range f.destinations {
+		m := &logger.Message{
+			Line:      append([]byte(nil), msg.Line...),
+			Source:    msg.Source,
+			Timestamp: msg.Timestamp,
+			Attrs:     msg.Attrs,
+		}
+		select {
+		case d.queue <- m:
+		default:
+			if atomic.AddUint64(&d.dropped, 1) == 1 {
+				logrus.WithField("destination", d.name).Warn("queue is full, dropping logs")
+			}
+		}
+	}
+	return nil
+}
+
+// Stats 返回每个目标的发送统计
+func (f *fanoutLogger) Stats() []DestinationStats {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	stats := make([]DestinationStats, 0, len(f.destinations))
+	for _, d := range f.destinations {
+		s := DestinationStats{
+			Name:    d.name,
+			Driver:  d.driver.Name(),
+			Sent:    atomic.LoadUint64(&d.sent),
+			Failed:  atomic.LoadUint64(&d.failed),
+			Dropped: atomic.LoadUint64(&d.dropped),
+			Queued:  len(d.queue),
+		}
+		// 批量发送的driver在Log之后才发送, 使用deliveryLogger的统计
+		if dl, ok := d.driver.(*deliveryLogger); ok {
+			dl.addStats(&s)
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// Close 等待所有队列中的事件发送完毕后关闭每个driver
+func (f *fanoutLogger) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	f.mu.Unlock()
+
+	var errs []string
+	for _, d := range f.destinations {
+		close(d.queue)
+		<-d.done
+		if err := d.driver.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", d.name, err))
+		}
+	}
+	for _, s := range f.Stats() {
+		logrus.WithFields(logrus.Fields{
+			"destination": s.Name,
+			"sent":        s.Sent,
+			"failed":      s.Failed,
+			"dropped":     s.Dropped,
+		}).Info("destination closed")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("fanout: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (f *fanoutLogger) Name() string {
+	return fanoutName
+}
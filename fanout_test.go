@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+func TestDestinationConfig(t *testing.T) {
+	cfg := map[string]string{
+		"drivers":             "graylog,archive:http",
+		"http-format":         "raw",
+		"graylog.gelf-addr":   "udp://graylog:12201",
+		"archive.http-url":    "http://archive/logs",
+		"archive.http-format": "ndjson",
+		"com.example.team":    "web",
+	}
+	names := map[string]bool{"graylog": true, "archive": true}
+	got := destinationConfig(cfg, "archive", names)
+	want := map[string]string{
+		"drivers":          "graylog,archive:http",
+		"http-format":      "ndjson",
+		"http-url":         "http://archive/logs",
+		"com.example.team": "web",
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+// TestFanoutIsolation 每个目标使用自己的参数, 一个目标变慢并且失败时其它目标仍然收到所有事件
+func TestFanoutIsolation(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var lines []string
+		s := bufio.NewScanner(r.Body)
+		for s.Scan() {
+			lines = append(lines, s.Text())
+		}
+		mu.Lock()
+		received[r.URL.Path] = append(received[r.URL.Path], lines...)
+		mu.Unlock()
+		if r.URL.Path == "/bad" {
+			time.Sleep(100 * time.Millisecond)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	l, err := NewFanout(logger.Info{
+		ContainerID:   "0123456789abcdef0123456789abcdef",
+		ContainerName: "/web",
+		Config: map[string]string{
+			"drivers":                "good:http,bad:http",
+			"http-format":            "raw",
+			"http-batch-size":        "1",
+			"retry-base-backoff":     "1ms",
+			"com.example.team":       "web",
+			"good.http-url":          srv.URL + "/good",
+			"bad.http-url":           srv.URL + "/bad",
+			"bad.retry-max-attempts": "1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for i := 0; i < 5; i++ {
+		want = append(want, "line "+string(rune('a'+i)))
+	}
+	logLines(t, l, want...)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(received["/good"])
+		mu.Unlock()
+		if n == len(want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("good destination got %d events while bad is failing", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	good := append([]string(nil), received["/good"]...)
+	sort.Strings(good)
+	if strings.Join(good, ",") != strings.Join(want, ",") {
+		t.Errorf("good destination got %q", good)
+	}
+	if len(received["/bad"]) == 0 {
+		t.Error("bad destination got no requests")
+	}
+
+	stats := l.(*fanoutLogger).Stats()
+	if len(stats) != 2 || stats[0].Name != "good" || stats[1].Name != "bad" {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats[0].Sent != 5 || stats[0].Failed != 0 {
+		t.Errorf("good destination: sent %d, failed %d", stats[0].Sent, stats[0].Failed)
+	}
+	if stats[1].Sent != 0 || stats[1].Failed != 5 {
+		t.Errorf("bad destination: sent %d, failed %d, want 0 and 5", stats[1].Sent, stats[1].Failed)
+	}
+	if stats[0].Lost != 0 || stats[1].Lost == 0 {
+		t.Errorf("got lost %d and %d, want only the bad destination to lose events", stats[0].Lost, stats[1].Lost)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/gogo/protobuf/proto"
+)
+
+const (
+	// maxFrameSize 单个LogEntry的最大长度, 超过后截断line
+	maxFrameSize = 1000000
+	// peekSize 读取FIFO的缓存大小, 不超过此长度的frame在读取之前检查全部的字段
+	peekSize = 64 * 1024
+)
+
+const (
+	// entrySourceField LogEntry的source字段, 值为stdout或者stderr
+	entrySourceField = 1
+	// maxEntryField 检查frame时接受的最大字段编号, 新版本的Docker可能增加字段(例如partial_log_metadata)
+	maxEntryField = 15
+)
+
+// entryWireTypes LogEntry已知字段的类型: source, time_nano, line, partial, partial_log_metadata
+var entryWireTypes = map[uint64]uint64{
+	1: proto.WireBytes,
+	2: proto.WireVarint,
+	3: proto.WireBytes,
+	4: proto.WireVarint,
+	5: proto.WireBytes,
+}
+
+// logReader 读取Docker写入FIFO的LogEntry(uint32长度 + protobuf). 与protoio的Uint32DelimitedReader不同,
+// 超过maxFrameSize的frame会截断line而不是返回错误; 无法解码的frame被跳过, 并在后续数据中查找下一个frame的开始.
+// ReadMsg只在FIFO结束(io.EOF)或者读取FIFO失败时返回错误
+type logReader struct {
+	r   *bufio.Reader
+	buf []byte
+	log *logrus.Entry
+
+	errors    uint64 /*无法解码的frame*/
+	truncated uint64 /*超过maxFrameSize被截断的frame*/
+	skipped   uint64 /*重新同步时跳过的字节*/
+}
+
+func newLogReader(r io.Reader, log *logrus.Entry) *logReader {
+	return &logReader{r: bufio.NewReaderSize(r, peekSize), log: log}
+}
+
+// ReadMsg 读取下一个LogEntry到e
+func (d *logReader) ReadMsg(e *logdriver.LogEntry) error {
+	for {
+		// 在读取frame之前检查长度和字段是否一致, 错误的长度不会吞掉后面正常的frame.
+		// 超过peekSize的frame只检查开始的peekSize字节
+		length, ok, err := d.peekFrame()
+		if err == io.ErrUnexpectedEOF {
+			d.corrupt("fifo closed in the middle of a frame")
+			return io.EOF
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			d.corrupt("invalid frame header, length %d", length)
+			if err := d.resync(); err != nil {
+				return err
+			}
+			continue
+		}
+		d.r.Discard(4)
+		if length > maxFrameSize {
+			return d.readTruncated(e, length)
+		}
+
+		if cap(d.buf) < length {
+			d.buf = make([]byte, length)
+		}
+		body := d.buf[:length]
+		if err := d.readFull(body); err != nil {
+			return err
+		}
+
+		e.Reset()
+		if err := e.Unmarshal(body); err != nil {
+			d.corrupt("cannot decode frame of %d bytes: %v", length, err)
+			continue
+		}
+		return nil
+	}
+}
+
+// peekFrame 不移动读取位置, 返回下一个frame的长度以及frame的字段是否与长度一致.
+// 检查所有已经缓存的数据, 只有在缓存的部分合法时才等待frame剩余的数据, 因此错误的长度不会等待后面的日志.
+// FIFO在frame的中间结束时返回io.ErrUnexpectedEOF
+func (d *logReader) peekFrame() (int, bool, error) {
+	b, err := d.r.Peek(4)
+	if err != nil {
+		if err == io.EOF && len(b) > 0 {
+			return 0, false, io.ErrUnexpectedEOF
+		}
+		return 0, false, err
+	}
+	length := int(binary.BigEndian.Uint32(b))
+	if length == 0 {
+		return 0, false, nil
+	}
+
+	for n := 5; ; {
+		if b, err = d.r.Peek(n); err != nil {
+			if err == io.EOF {
+				return length, false, io.ErrUnexpectedEOF
+			}
+			return 0, false, err
+		}
+		if buffered := d.r.Buffered(); buffered > n {
+			b, _ = d.r.Peek(buffered)
+		}
+		body := b[4:]
+		if len(body) > length {
+			body = body[:length]
+		}
+		if !validFrame(body, length) {
+			return length, false, nil
+		}
+		// 整个frame已经检查, 或者frame超过缓存的大小
+		if len(body) == length || len(b) == d.r.Size() {
+			return length, true, nil
+		}
+		n = len(b) + 1
+	}
+}
+
+// validFrame 检查frame开始的部分b是否是一个长度为length的LogEntry: 字段可以是任意顺序, 第一个字段之后可以有未知的字段,
+// 但是字段编号和类型必须合理, 每个字段不能超出frame, source必须是stdout或者stderr.
+// b包含整个frame时字段必须正好在length结束. 第一个字段必须是已知的字段, 否则重新同步时容易把日志内容当作frame的开始
+func validFrame(b []byte, length int) bool {
+	if length == 0 || len(b) == 0 {
+		return false
+	}
+	complete := len(b) >= length
+	i := 0
+	for i < len(b) && i < length {
+		key, n := proto.DecodeVarint(b[i:])
+		if n == 0 {
+			// 只读取了frame的一部分时, varint可能被截断
+			return !complete
+		}
+		field, wire := key>>3, key&7
+		if field == 0 || field > maxEntryField {
+			return false
+		}
+		want, known := entryWireTypes[field]
+		if (known && want != wire) || (!known && i == 0) {
+			return false
+		}
+		i += n
+
+		v, n := proto.DecodeVarint(b[i:])
+		if n == 0 {
+			return !complete
+		}
+		if i += n; i > length {
+			return false
+		}
+		switch wire {
+		case proto.WireVarint:
+		case proto.WireBytes:
+			if v > uint64(length-i) {
+				return false
+			}
+			end := i + int(v)
+			if field == entrySourceField && end <= len(b) && !isEntrySource(b[i:end]) {
+				return false
+			}
+			i = end
+		default:
+			return false
+		}
+	}
+	if complete {
+		return i == length
+	}
+	return i <= length
+}
+
+// readFull 读取len(b)个字节, frame读到一半时FIFO结束也作为io.EOF返回
+func (d *logReader) readFull(b []byte) error {
+	_, err := io.ReadFull(d.r, b)
+	if err == io.ErrUnexpectedEOF {
+		d.corrupt("fifo closed in the middle of a frame")
+		return io.EOF
+	}
+	return err
+}
+
+// readTruncated 读取超过maxFrameSize的frame, 只保留line的前一部分, 其余的数据被丢弃.
+// line之后的字段(partial)同时被丢弃
+func (d *logReader) readTruncated(e *logdriver.LogEntry, length int) error {
+	if cap(d.buf) < maxFrameSize {
+		d.buf = make([]byte, maxFrameSize)
+	}
+	head := d.buf[:maxFrameSize]
+	if err := d.readFull(head); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(ioutil.Discard, d.r, int64(length-maxFrameSize)); err != nil {
+		if err == io.EOF {
+			d.corrupt("fifo closed in the middle of a frame")
+		}
+		return err
+	}
+
+	e.Reset()
+	for i := 0; i < len(head); {
+		key, n := proto.DecodeVarint(head[i:])
+		if n == 0 {
+			break
+		}
+		i += n
+		v, n := proto.DecodeVarint(head[i:])
+		if n == 0 {
+			break
+		}
+		i += n
+
+		switch key & 7 {
+		case proto.WireVarint:
+			switch key >> 3 {
+			case 2:
+				e.TimeNano = int64(v)
+			case 4:
+				e.Partial = v != 0
+			}
+			continue
+		case proto.WireBytes:
+		default:
+			i = len(head)
+			continue
+		}
+
+		end := i + int(v)
+		if end > len(head) || end < i {
+			end = len(head)
+		}
+		switch key >> 3 {
+		case 1:
+			e.Source = string(head[i:end])
+		case 3:
+			e.Line = append([]byte(nil), head[i:end]...)
+		}
+		i = end
+	}
+
+	atomic.AddUint64(&d.truncated, 1)
+	d.log.Warnf("log entry of %d bytes exceeds %d bytes, line truncated to %d bytes", length, maxFrameSize, len(e.Line))
+	return nil
+}
+
+// resync 跳过数据直到下一个看起来像frame开始的位置
+func (d *logReader) resync() error {
+	var skipped uint64
+	defer func() {
+		atomic.AddUint64(&d.skipped, skipped)
+		if skipped > 0 {
+			d.log.Warnf("skipped %d bytes to find the next log entry", skipped)
+		}
+	}()
+
+	for {
+		d.r.Discard(1)
+		skipped++
+		// 剩余的数据不足以检查时继续跳过, 后面可能还有较短的frame
+		_, ok, err := d.peekFrame()
+		if err == io.ErrUnexpectedEOF {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+}
+
+func (d *logReader) corrupt(format string, args ...interface{}) {
+	atomic.AddUint64(&d.errors, 1)
+	d.log.Warnf(format, args...)
+}
+
+func isEntrySource(b []byte) bool {
+	return bytes.Equal(b, []byte("stdout")) || bytes.Equal(b, []byte("stderr"))
+}
+
+// DecodeStats 读取FIFO的统计
+type DecodeStats struct {
+	Errors       uint64 `json:"errors"`
+	Truncated    uint64 `json:"truncated"`
+	SkippedBytes uint64 `json:"skipped_bytes"`
+}
+
+func (d *logReader) stats() DecodeStats {
+	return DecodeStats{
+		Errors:       atomic.LoadUint64(&d.errors),
+		Truncated:    atomic.LoadUint64(&d.truncated),
+		SkippedBytes: atomic.LoadUint64(&d.skipped),
+	}
+}
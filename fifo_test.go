@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/gogo/protobuf/proto"
+)
+
+// frame 在body前加上uint32长度
+func frame(body []byte) []byte {
+	b := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(b, uint32(len(body)))
+	return append(b, body...)
+}
+
+// entryFrame Docker写入的frame
+func entryFrame(t *testing.T, line string) []byte {
+	e := &logdriver.LogEntry{Source: "stdout", TimeNano: 1500000000000000000, Line: []byte(line)}
+	body, err := e.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame(body)
+}
+
+func bytesField(field uint64, v []byte) []byte {
+	b := proto.EncodeVarint(field<<3 | proto.WireBytes)
+	b = append(b, proto.EncodeVarint(uint64(len(v)))...)
+	return append(b, v...)
+}
+
+func varintField(field, v uint64) []byte {
+	return append(proto.EncodeVarint(field<<3|proto.WireVarint), proto.EncodeVarint(v)...)
+}
+
+// readAll 读取所有的LogEntry, 返回每个LogEntry的line以及ReadMsg最后返回的错误
+func readAll(data []byte) ([]string, DecodeStats, error) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	d := newLogReader(bytes.NewReader(data), logrus.NewEntry(log))
+	var lines []string
+	for {
+		var e logdriver.LogEntry
+		if err := d.ReadMsg(&e); err != nil {
+			return lines, d.stats(), err
+		}
+		lines = append(lines, string(e.Line))
+	}
+}
+
+func TestLogReader(t *testing.T) {
+	first, second := entryFrame(t, "first"), entryFrame(t, "second")
+	long := strings.Repeat("x", maxFrameSize+100)
+
+	// 字段顺序与Docker不同, 并且带有partial_log_metadata(字段5)
+	var reordered []byte
+	reordered = append(reordered, bytesField(3, []byte("reordered"))...)
+	reordered = append(reordered, varintField(2, 1500000000000000000)...)
+	reordered = append(reordered, bytesField(5, append(varintField(1, 1), bytesField(2, []byte("id"))...))...)
+	reordered = append(reordered, varintField(4, 1)...)
+	reordered = append(reordered, bytesField(1, []byte("stderr"))...)
+
+	for _, c := range []struct {
+		name    string
+		data    []byte
+		lines   []string
+		errors  uint64
+		skipped bool
+	}{
+		{
+			name:  "valid",
+			data:  bytes.Join([][]byte{first, second}, nil),
+			lines: []string{"first", "second"},
+		},
+		{
+			name:  "other field order and extra fields",
+			data:  bytes.Join([][]byte{first, frame(reordered), second}, nil),
+			lines: []string{"first", "reordered", "second"},
+		},
+		{
+			name:   "truncated length prefix",
+			data:   bytes.Join([][]byte{first, {0x00, 0x00}}, nil),
+			lines:  []string{"first"},
+			errors: 1,
+		},
+		{
+			name:   "truncated frame",
+			data:   bytes.Join([][]byte{first, second[:len(second)-3]}, nil),
+			lines:  []string{"first"},
+			errors: 1,
+		},
+		{
+			name:  "oversized length",
+			data:  bytes.Join([][]byte{entryFrame(t, long), second}, nil),
+			lines: []string{long[:maxFrameSize-32], "second"},
+		},
+		{
+			name:    "length larger than the frame",
+			data:    bytes.Join([][]byte{{0x00, 0x0f, 0x00, 0x00}, first[4:], second}, nil),
+			lines:   []string{"second"},
+			errors:  1,
+			skipped: true,
+		},
+		{
+			name:    "large length before valid frames",
+			data:    bytes.Join([][]byte{{0x00, 0x00, 0x13, 0x88}, entryFrame(t, strings.Repeat("y", 40))[4:], first, second}, nil),
+			lines:   []string{"first", "second"},
+			errors:  1,
+			skipped: true,
+		},
+		{
+			name:    "garbage between frames",
+			data:    bytes.Join([][]byte{first, []byte("\x00garbage\x0a\x06stdout\xff\xff"), second}, nil),
+			lines:   []string{"first", "second"},
+			errors:  1,
+			skipped: true,
+		},
+		{
+			name:    "garbage before the first frame",
+			data:    bytes.Join([][]byte{[]byte("garbage"), first, second}, nil),
+			lines:   []string{"first", "second"},
+			errors:  1,
+			skipped: true,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			lines, stats, err := readAll(c.data)
+			if err != io.EOF {
+				t.Errorf("got error %v, want EOF", err)
+			}
+			if len(lines) != len(c.lines) {
+				t.Fatalf("got %d lines, want %d", len(lines), len(c.lines))
+			}
+			for i := range lines {
+				if !strings.HasPrefix(lines[i], c.lines[i]) || len(lines[i]) > maxFrameSize {
+					t.Errorf("line %d: got %.40q (%d bytes), want %.40q", i, lines[i], len(lines[i]), c.lines[i])
+				}
+			}
+			if stats.Errors != c.errors {
+				t.Errorf("got %d errors, want %d", stats.Errors, c.errors)
+			}
+			if (stats.SkippedBytes > 0) != c.skipped {
+				t.Errorf("skipped %d bytes", stats.SkippedBytes)
+			}
+		})
+	}
+}
+
+// TestLogReaderNoWait 错误的长度之后的frame已经写入FIFO时, 不等待后面的日志就可以读取
+func TestLogReaderNoWait(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	d := newLogReader(r, logrus.NewEntry(log))
+
+	// 长度为5000, 开始的部分是一个合法的LogEntry
+	go w.Write(bytes.Join([][]byte{{0x00, 0x00, 0x13, 0x88}, entryFrame(t, strings.Repeat("y", 40))[4:], entryFrame(t, "first")}, nil))
+	lines := make(chan string)
+	go func() {
+		var e logdriver.LogEntry
+		if err := d.ReadMsg(&e); err != nil {
+			t.Error(err)
+		}
+		lines <- string(e.Line)
+	}()
+	select {
+	case line := <-lines:
+		if line != "first" {
+			t.Errorf("got %q, want first", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadMsg waits for the rest of a frame with an invalid length")
+	}
+}
+
+func TestValidFrame(t *testing.T) {
+	body := entryFrame(t, "line")[4:]
+	for _, c := range []struct {
+		name   string
+		b      []byte
+		length int
+		want   bool
+	}{
+		{"docker frame", body, len(body), true},
+		{"partial peek", body[:6], len(body), true},
+		{"longer than fields", append(append([]byte(nil), body...), 0xff, 0xff), len(body) + 2, false},
+		{"shorter than fields", body, len(body) - 1, false},
+		{"unknown source", bytesField(1, []byte("stdin")), 7, false},
+		{"wrong wire type", varintField(1, 1), 2, false},
+		{"unknown field", append(bytesField(1, []byte("stdout")), bytesField(12, []byte("x"))...), 11, true},
+		{"unknown first field", bytesField(12, []byte("x")), 3, false},
+		{"field out of range", bytesField(100, []byte("x")), 4, false},
+		{"empty", nil, 0, false},
+	} {
+		if got := validFrame(c.b, c.length); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/daemon/logger/loggerutils"
+)
+
+const (
+	fluentdName           = "fluentd"
+	defaultFluentdAddress = "tcp://127.0.0.1:24224"
+	defaultFluentdTimeout = 10 * time.Second
+	defaultFluentdRetry   = 1
+	fluentdRetryInterval  = 100 * time.Millisecond
+)
+
+// fluentdLogger 使用fluentd forward协议(Forward/PackedForward模式)发送日志,
+// 支持tcp和unix socket, fluentd-ack=true时每次发送都携带chunk并等待服务端的ack
+type fluentdLogger struct {
+	mu        sync.Mutex
+	network   string
+	address   string
+	conn      net.Conn
+	reader    *bufio.Reader
+	tag       string
+	extra     map[string]interface{}
+	packed    bool
+	ack       bool
+	subsecond bool
+	timeout   time.Duration
+	retry     *retryPolicy
+	batch     *batcher
+}
+
+// NewFluentd creates a fluentd logger. The supported log opts are
+// fluentd-address, fluentd-mode, fluentd-ack, fluentd-batch-size,
+// fluentd-flush-interval, fluentd-write-timeout and fluentd-subsecond-precision.
+func NewFluentd(info logger.Info) (logger.Logger, error) {
+	network, address, err := parseFluentdAddress(info.Config["fluentd-address"])
+	if err != nil {
+		return nil, err
+	}
+
+	tag, err := loggerutils.ParseLogTag(info, loggerutils.DefaultTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	extra, err := containerExtra(info, "")
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fluentdLogger{
+		network: network,
+		address: address,
+		tag:     tag,
+		extra:   extra,
+		timeout: defaultFluentdTimeout,
+	}
+
+	switch info.Config["fluentd-mode"] {
+	case "", "forward":
+	case "packed":
+		f.packed = true
+	default:
+		return nil, fmt.Errorf("fluentd: unknown fluentd-mode %q, must be forward or packed", info.Config["fluentd-mode"])
+	}
+
+	for key, val := range info.Config {
+		switch key {
+		case "fluentd-ack":
+			if f.ack, err = strconv.ParseBool(val); err != nil {
+				return nil, fmt.Errorf("fluentd: %s must be true or false", key)
+			}
+		case "fluentd-subsecond-precision":
+			if f.subsecond, err = strconv.ParseBool(val); err != nil {
+				return nil, fmt.Errorf("fluentd: %s must be true or false", key)
+			}
+		}
+	}
+
+	if d, err := parseDuration(info.Config, "fluentd-write-timeout"); err != nil {
+		return nil, err
+	} else if d > 0 {
+		f.timeout = d
+	}
+
+	if f.retry, err = newRetryPolicy(info.Config, fluentdName, defaultFluentdRetry, fluentdRetryInterval); err != nil {
+		return nil, fmt.Errorf("fluentd: %v", err)
+	}
+
+	size := 1
+	if v, ok := info.Config["fluentd-batch-size"]; ok {
+		if size, err = strconv.Atoi(v); err != nil || size < 1 {
+			return nil, fmt.Errorf("fluentd: fluentd-batch-size must be a positive integer")
+		}
+	}
+
+	interval, err := parseDuration(info.Config, "fluentd-flush-interval")
+	if err != nil {
+		return nil, err
+	}
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	f.batch = newBatcher(fluentdName, size, interval, f.send)
+	return f, nil
+}
+
+func parseFluentdAddress(address string) (string, string, error) {
+	if address == "" {
+		address = defaultFluentdAddress
+	}
+	if !strings.Contains(address, "://") {
+		address = "tcp://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", fmt.Errorf("fluentd: invalid fluentd-address %q: %v", address, err)
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return "", "", fmt.Errorf("fluentd: please provide fluentd-address as tcp://host:port")
+		}
+		return "tcp", u.Host, nil
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("fluentd: please provide fluentd-address as unix:///path/to/socket")
+		}
+		return "unix", u.Path, nil
+	default:
+		return "", "", fmt.Errorf("fluentd: endpoint needs to be tcp or unix, got %q", u.Scheme)
+	}
+}
+
+func (f *fluentdLogger) Log(msg *logger.Message) error {
+	err := f.batch.Add(msg)
+	logger.PutMessage(msg)
+	return err
+}
+
+// send 将一批消息编码为一个Forward或者PackedForward消息发送给fluentd
+func (f *fluentdLogger) send(msgs []*logger.Message) error {
+	var entries []interface{}
+	var packed []byte
+	for _, m := range msgs {
+		entry := []interface{}{f.timestamp(m.Timestamp), f.record(m)}
+		if f.packed {
+			packed = appendMsgpack(packed, entry)
+		} else {
+			entries = append(entries, entry)
+		}
+	}
+
+	option := map[string]interface{}{}
+	var chunk string
+	if f.ack {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return fmt.Errorf("fluentd: cannot generate chunk id: %v", err)
+		}
+		chunk = base64.StdEncoding.EncodeToString(id)
+		option["chunk"] = chunk
+	}
+
+	var data []byte
+	if f.packed {
+		option["size"] = len(msgs)
+		data = appendMsgpack(nil, []interface{}{f.tag, packed, option})
+	} else {
+		data = appendMsgpack(nil, []interface{}{f.tag, entries, option})
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// 连接可能已经被服务端关闭, 失败后重新连接再发送
+	return f.retry.do(fluentdName, func() error {
+		err := f.write(data, chunk)
+		if err != nil {
+			f.closeConn()
+			return fmt.Errorf("cannot send message to %s: %v", f.address, err)
+		}
+		return nil
+	})
+}
+
+func (f *fluentdLogger) write(data []byte, chunk string) error {
+	if f.conn == nil {
+		conn, err := net.DialTimeout(f.network, f.address, f.timeout)
+		if err != nil {
+			return err
+		}
+		f.conn = conn
+		f.reader = bufio.NewReader(conn)
+	}
+
+	f.conn.SetDeadline(time.Now().Add(f.timeout))
+	if _, err := f.conn.Write(data); err != nil {
+		return err
+	}
+	if chunk == "" {
+		return nil
+	}
+
+	resp, err := decodeMsgpack(f.reader)
+	if err != nil {
+		return fmt.Errorf("cannot read ack: %v", err)
+	}
+	if m, ok := resp.(map[string]interface{}); !ok || m["ack"] != chunk {
+		return fmt.Errorf("unexpected ack response %v", resp)
+	}
+	return nil
+}
+
+func (f *fluentdLogger) closeConn() {
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+		f.reader = nil
+	}
+}
+
+func (f *fluentdLogger) timestamp(t time.Time) interface{} {
+	if f.subsecond {
+		return eventTime(t)
+	}
+	return t.Unix()
+}
+
+func (f *fluentdLogger) record(msg *logger.Message) map[string]interface{} {
+	record := make(map[string]interface{}, len(f.extra)+len(msg.Attrs)+2)
+	for k, v := range f.extra {
+		record[k] = v
+	}
+	for k, v := range msg.Attrs {
+		record[k] = v
+	}
+	record["log"] = string(msg.Line)
+	record["source"] = msg.Source
+	return record
+}
+
+func (f *fluentdLogger) Close() error {
+	err := f.batch.Close()
+	f.mu.Lock()
+	f.closeConn()
+	f.mu.Unlock()
+	return err
+}
+
+func (f *fluentdLogger) batches() *batcher {
+	return f.batch
+}
+
+func (f *fluentdLogger) Name() string {
+	return fluentdName
+}
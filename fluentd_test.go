@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// forwardServer 模拟fluentd的forward输入, 收到的每个record的log字段发送到records
+type forwardServer struct {
+	l       net.Listener
+	records chan string
+	acks    chan string
+}
+
+func newForwardServer(t *testing.T) *forwardServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &forwardServer{l: l, records: make(chan string, 16), acks: make(chan string, 16)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(t, conn)
+		}
+	}()
+	return s
+}
+
+func (s *forwardServer) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		v, err := decodeMsgpack(r)
+		if err != nil {
+			return
+		}
+		msg, ok := v.([]interface{})
+		if !ok || len(msg) != 3 {
+			t.Errorf("unexpected forward message %v", v)
+			return
+		}
+
+		var entries []interface{}
+		switch e := msg[1].(type) {
+		case []interface{}:
+			entries = e
+		case []byte:
+			// PackedForward: entries编码后连接在一起
+			er := bufio.NewReader(bytes.NewReader(e))
+			for {
+				entry, err := decodeMsgpack(er)
+				if err != nil {
+					break
+				}
+				entries = append(entries, entry)
+			}
+		default:
+			t.Errorf("unexpected entries %T", msg[1])
+			return
+		}
+		for _, e := range entries {
+			record := e.([]interface{})[1].(map[string]interface{})
+			s.records <- record["log"].(string)
+		}
+
+		option := msg[2].(map[string]interface{})
+		if chunk, ok := option["chunk"].(string); ok {
+			s.acks <- chunk
+			conn.Write(appendMsgpack(nil, map[string]interface{}{"ack": chunk}))
+		}
+	}
+}
+
+func TestFluentdForward(t *testing.T) {
+	for _, mode := range []string{"forward", "packed"} {
+		t.Run(mode, func(t *testing.T) {
+			s := newForwardServer(t)
+			defer s.l.Close()
+
+			l, err := NewFluentd(logger.Info{
+				ContainerID:   "0123456789abcdef0123456789abcdef",
+				ContainerName: "/web",
+				Config: map[string]string{
+					"fluentd-address":        "tcp://" + s.l.Addr().String(),
+					"fluentd-mode":           mode,
+					"fluentd-ack":            "true",
+					"fluentd-batch-size":     "2",
+					"fluentd-flush-interval": "1h",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range []string{"first", "second"} {
+				m := logger.NewMessage()
+				m.Line = []byte(line)
+				m.Source = "stdout"
+				m.Timestamp = time.Now()
+				if err := l.Log(m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range []string{"first", "second"} {
+				select {
+				case got := <-s.records:
+					if got != want {
+						t.Errorf("got %q, want %q", got, want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("%q not received", want)
+				}
+			}
+			select {
+			case <-s.acks:
+			default:
+				t.Error("no chunk sent with fluentd-ack=true")
+			}
+			if len(s.acks) > 0 {
+				t.Errorf("%d extra chunks, want one batch", len(s.acks))
+			}
+		})
+	}
+}
+
+func TestDecodeMsgpackLimits(t *testing.T) {
+	nested := bytes.Repeat([]byte{0x91}, maxMsgpackDepth+2)
+	for name, b := range map[string][]byte{
+		"str32":  {0xdb, 0x7f, 0xff, 0xff, 0xff},
+		"bin32":  {0xc6, 0x7f, 0xff, 0xff, 0xff},
+		"ext32":  {0xc9, 0x7f, 0xff, 0xff, 0xff, 0x01},
+		"array":  {0xdd, 0xff, 0xff, 0xff, 0xff},
+		"map":    {0xdf, 0x00, 0x10, 0x00, 0x00},
+		"nested": append(nested, 0xc0),
+	} {
+		if v, err := decodeMsgpack(bufio.NewReader(bytes.NewReader(b))); err == nil {
+			t.Errorf("%s: decoded %v, want an error", name, v)
+		}
+	}
+
+	// 声明的元素个数大于实际内容时读取失败, 不会按照声明的长度分配
+	if _, err := decodeMsgpack(bufio.NewReader(bytes.NewReader([]byte{0xdd, 0x00, 0x00, 0xff, 0xff}))); err == nil {
+		t.Error("truncated array decoded")
+	}
+	if v, err := decodeMsgpack(bufio.NewReader(bytes.NewReader(appendMsgpack(nil, map[string]interface{}{"ack": "abc"})))); err != nil {
+		t.Error(err)
+	} else if v.(map[string]interface{})["ack"] != "abc" {
+		t.Errorf("got %v", v)
+	}
+}
@@ -13,7 +13,6 @@ import (
 
 	"gopkg.in/Graylog2/go-gelf.v2/gelf"
 	"github.com/docker/docker/daemon/logger"
-	"github.com/docker/docker/daemon/logger/loggerutils"
 	"github.com/docker/docker/pkg/urlutil"
 )
 
@@ -50,37 +49,11 @@ func NewGelf(info logger.Info) (logger.Logger, error) {
 		return nil, fmt.Errorf("gelf: cannot access hostname to set source field")
 	}
 
-	// parse log tag
-	tag, err := loggerutils.ParseLogTag(info, loggerutils.DefaultTemplate)
+	extra, err := containerExtra(info, "_")
 	if err != nil {
 		return nil, err
 	}
 
-	extra := map[string]interface{}{
-		"_container_id":   info.ContainerID,
-		"_container_name": info.Name(),
-		"_image_id":       info.ContainerImageID,
-		"_image_name":     info.ContainerImageName,
-		"_command":        info.Command(),
-		"_tag":            tag,
-		"_created":        info.ContainerCreated,
-	}
-
-	extraAttrs, err := info.ExtraAttributes(func(key string) string {
-		if key[0] == '_' {
-			return key
-		}
-		return "_" + key
-	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	for k, v := range extraAttrs {
-		extra[k] = v
-	}
-
 	rawExtra, err := json.Marshal(extra)
 	if err != nil {
 		return nil, err
@@ -178,6 +151,16 @@ func (s *gelfLogger) Log(msg *logger.Message) error {
 		Level:    int32(level),
 		RawExtra: s.rawExtra,
 	}
+	for k, v := range msg.Attrs {
+		if m.Extra == nil {
+			m.Extra = make(map[string]interface{}, len(msg.Attrs))
+		}
+		if i, err := strconv.Atoi(v); err == nil {
+			m.Extra["_"+k] = i
+		} else {
+			m.Extra["_"+k] = v
+		}
+	}
 	logger.PutMessage(msg)
 
 	if err := s.writer.WriteMessage(&m); err != nil {
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+)
+
+// lineGroup 一个stream(stdout/stderr)正在合并的日志, 合并后的事件只包含同一个stream的行
+type lineGroup struct {
+	tempStr []string           /*缓存的日志*/
+	head    logdriver.LogEntry /*tempStr中第一行日志的元数据*/
+	lastTs  int64              /*tempStr中最后一行日志的时间*/
+	state   int                /*multiline-preset的堆栈状态*/
+	opened  time.Time          /*tempStr中第一行的到达时间*/
+	last    time.Time          /*tempStr中最后一行的到达时间*/
+}
+
+// group 返回stream对应的lineGroup
+func (lf *logPair) group(source string) *lineGroup {
+	g := lf.groups[source]
+	if g == nil {
+		g = &lineGroup{}
+		lf.groups[source] = g
+	}
+	return g
+}
+
+// groupLine 按照multiline规则或者bufLines合并日志行, 事件完整后发送给driver
+func (lf *logPair) groupLine(buf *logdriver.LogEntry) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	g := lf.group(buf.Source)
+	atomic.AddUint64(&lf.lines, 1)
+	atomic.AddInt64(&lf.pending, 1)
+
+	if lf.ml == nil {
+		g.appendLine(buf)
+		if len(g.tempStr) >= lf.bufLines {
+			lf.flushLines(g)
+		}
+		return
+	}
+
+	cont := lf.ml.cont(&g.state, buf.Line)
+
+	if lf.ml.before {
+		g.appendLine(buf)
+		if !cont {
+			lf.flushLines(g)
+		}
+		return
+	}
+
+	if !cont {
+		lf.flushLines(g)
+	}
+	g.appendLine(buf)
+}
+
+// flushLoop 定时检查tempStr, 空闲超过flushInterval或者等待超过maxWait的事件不再等待后续日志, 直接发送.
+// 开启dedup时同时发送超过dedup-window的汇总事件
+func (lf *logPair) flushLoop() {
+	tick := lf.flushInterval
+	if tick == 0 || (lf.maxWait > 0 && lf.maxWait < tick) {
+		tick = lf.maxWait
+	}
+	if lf.dedup != nil && (tick == 0 || lf.dedup.window < tick) {
+		tick = lf.dedup.window
+	}
+	if tick < 20*time.Millisecond {
+		tick = 20 * time.Millisecond
+	}
+	t := time.NewTicker(tick / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-lf.done:
+			return
+		case now := <-t.C:
+			lf.mu.Lock()
+			for _, g := range lf.groups {
+				if len(g.tempStr) > 0 &&
+					(lf.flushInterval > 0 && now.Sub(g.last) >= lf.flushInterval ||
+						lf.maxWait > 0 && now.Sub(g.opened) >= lf.maxWait) {
+					lf.flushLines(g)
+				}
+			}
+			if lf.dedup != nil && lf.dedup.expired(now) {
+				lf.dedup.flush(lf.sendLine)
+			}
+			lf.mu.Unlock()
+		}
+	}
+}
+
+// flushAll 发送所有stream中未完成的事件
+func (lf *logPair) flushAll() {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	for _, g := range lf.groups {
+		lf.flushLines(g)
+	}
+	if lf.dedup != nil {
+		lf.dedup.flush(lf.sendLine)
+	}
+}
+
+// flushLines 将tempStr中缓存的日志使用separator合并为一个事件发送给driver,
+// 事件的Attrs中记录合并的行数以及第一行和最后一行的时间, 合并了多行时记录multiline=true
+func (lf *logPair) flushLines(g *lineGroup) {
+	if len(g.tempStr) == 0 {
+		return
+	}
+	msg := g.head
+	msg.Line = []byte(strings.Join(g.tempStr, lf.separator))
+	attrs := map[string]string{
+		"line_count":    strconv.Itoa(len(g.tempStr)),
+		"first_line_ts": time.Unix(0, g.head.TimeNano).UTC().Format(time.RFC3339Nano),
+		"last_line_ts":  time.Unix(0, g.lastTs).UTC().Format(time.RFC3339Nano),
+	}
+	if len(g.tempStr) > 1 {
+		attrs["multiline"] = "true"
+	}
+	atomic.AddInt64(&lf.pending, -int64(len(g.tempStr)))
+	lf.send(&msg, attrs)
+	g.tempStr = g.tempStr[:0]
+}
+
+// send 合并后的事件经过dedup后发送给driver
+func (lf *logPair) send(msg *logdriver.LogEntry, attrs map[string]string) {
+	if lf.dedup != nil {
+		lf.dedup.add(msg, attrs, lf.sendLine)
+		return
+	}
+	lf.sendLine(msg, attrs)
+}
+
+func (lf *logPair) sendLine(msg *logdriver.LogEntry, attrs map[string]string) {
+	if sendMessage(lf.driver, msg, attrs, lf.info.ContainerID) {
+		atomic.AddUint64(&lf.sent, 1)
+	} else {
+		atomic.AddUint64(&lf.sendErrors, 1)
+	}
+}
+
+// appendLine 将一行日志放入tempStr, 并记录事件第一行的元数据
+func (g *lineGroup) appendLine(buf *logdriver.LogEntry) {
+	now := time.Now()
+	if len(g.tempStr) == 0 {
+		g.head = logdriver.LogEntry{Source: buf.Source, TimeNano: buf.TimeNano}
+		g.opened = now
+	}
+	g.tempStr = append(g.tempStr, string(buf.Line))
+	g.lastTs = buf.TimeNano
+	g.last = now
+}
+
+// parseSeparator 解析multiline-separator, 支持\n \t \r等转义字符, 默认为\n
+func parseSeparator(cfg map[string]string) (string, error) {
+	v, ok := cfg["multiline-separator"]
+	if !ok {
+		return "\n", nil
+	}
+	sep, err := strconv.Unquote(`"` + strings.Replace(v, `"`, `\"`, -1) + `"`)
+	if err != nil {
+		return "", fmt.Errorf("invalid multiline-separator %q: %v", v, err)
+	}
+	return sep, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+)
+
+func newTestPair(c *captureLogger, bufLines int) *logPair {
+	return &logPair{driver: c, bufLines: bufLines, separator: "\n", groups: make(map[string]*lineGroup)}
+}
+
+func TestParseSeparator(t *testing.T) {
+	for v, want := range map[string]string{
+		`\n`:     "\n",
+		`\r\n`:   "\r\n",
+		`\t`:     "\t",
+		` | `:    " | ",
+		`"`:      `"`,
+		`\u00b7`: "·",
+	} {
+		got, err := parseSeparator(map[string]string{"multiline-separator": v})
+		if err != nil || got != want {
+			t.Errorf("parseSeparator(%q) = %q, %v, want %q", v, got, err, want)
+		}
+	}
+	if got, err := parseSeparator(map[string]string{}); err != nil || got != "\n" {
+		t.Errorf("default separator %q, %v", got, err)
+	}
+	if _, err := parseSeparator(map[string]string{"multiline-separator": `\q`}); err == nil {
+		t.Error("invalid escape accepted")
+	}
+}
+
+// TestFlushLinesMetadata 合并的事件带有行数和首尾两行的时间, 只有合并了多行时带有multiline=true
+func TestFlushLinesMetadata(t *testing.T) {
+	c := &captureLogger{}
+	lf := newTestPair(c, 2)
+	lf.separator = " | "
+	first := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	for i, line := range []string{"a", "b", "single"} {
+		lf.groupLine(&logdriver.LogEntry{Source: "stdout", Line: []byte(line), TimeNano: first.Add(time.Duration(i) * time.Second).UnixNano()})
+	}
+	lf.flushAll()
+
+	events := c.events()
+	if len(events) != 2 || events[0] != "a | b" || events[1] != "single" {
+		t.Fatalf("got events %q", events)
+	}
+	combined, single := c.attrs[0], c.attrs[1]
+	for k, want := range map[string]string{
+		"line_count":    "2",
+		"first_line_ts": "2024-03-05T10:00:00Z",
+		"last_line_ts":  "2024-03-05T10:00:01Z",
+		"multiline":     "true",
+	} {
+		if combined[k] != want {
+			t.Errorf("combined event %s = %q, want %q", k, combined[k], want)
+		}
+	}
+	if single["line_count"] != "1" || single["first_line_ts"] != "2024-03-05T10:00:02Z" || single["last_line_ts"] != single["first_line_ts"] {
+		t.Errorf("unexpected single-line attrs %v", single)
+	}
+	if v, ok := single["multiline"]; ok {
+		t.Errorf("single-line event has multiline=%q", v)
+	}
+}
+
+// TestFlushInterval 没有后续日志时, 单独的一行在空闲flush-interval之后发送, 不会提前发送
+func TestFlushInterval(t *testing.T) {
+	c := &captureLogger{}
+	lf := newTestPair(c, 10)
+	lf.flushInterval = 100 * time.Millisecond
+	lf.done = make(chan struct{})
+	defer close(lf.done)
+	go lf.flushLoop()
+
+	start := time.Now()
+	lf.groupLine(&logdriver.LogEntry{Source: "stdout", Line: []byte("lonely"), TimeNano: start.UnixNano()})
+	for len(c.events()) == 0 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("pending line not flushed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	if elapsed < lf.flushInterval {
+		t.Errorf("flushed after %v, before the flush interval", elapsed)
+	}
+	// 每flushInterval/2检查一次, 最多延迟半个interval
+	if elapsed > 2*lf.flushInterval {
+		t.Errorf("flushed after %v, want at most %v", elapsed, 2*lf.flushInterval)
+	}
+	if got := c.events(); len(got) != 1 || got[0] != "lonely" {
+		t.Errorf("got events %q", got)
+	}
+}
+
+// TestInterleavedStreams stdout和stderr交替输出时分别合并, 一个事件只包含同一个stream的行
+func TestInterleavedStreams(t *testing.T) {
+	c := &captureLogger{}
+	lf := newTestPair(c, 10)
+	ml, err := newMultiline(map[string]string{"multiline-pattern": `^\s`, "multiline-match": "after"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.ml = ml
+	for _, l := range []struct{ source, line string }{
+		{"stdout", "request 1"},
+		{"stderr", "panic: boom"},
+		{"stdout", "  header"},
+		{"stderr", "  at main.go:10"},
+		{"stdout", "  body"},
+		{"stderr", "  at main.go:20"},
+		{"stdout", "request 2"},
+		{"stderr", "panic: again"},
+	} {
+		lf.groupLine(&logdriver.LogEntry{Source: l.source, Line: []byte(l.line), TimeNano: time.Now().UnixNano()})
+	}
+	lf.flushAll()
+
+	got := make(map[string]bool)
+	for _, e := range c.events() {
+		got[e] = true
+	}
+	for _, want := range []string{
+		"request 1\n  header\n  body",
+		"panic: boom\n  at main.go:10\n  at main.go:20",
+		"request 2",
+		"panic: again",
+	} {
+		if !got[want] {
+			t.Errorf("event %q missing, got %q", want, c.events())
+		}
+	}
+	if len(c.events()) != 4 {
+		t.Errorf("got %d events, want 4", len(c.events()))
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	httpName           = "http"
+	defaultHTTPBatch   = 100
+	defaultHTTPBytes   = 1 << 20
+	defaultHTTPRetry   = 3
+	defaultHTTPSuccess = "200-299"
+	httpRetryInterval  = 500 * time.Millisecond
+)
+
+// httpLogger 通过HTTP POST批量发送日志, 请求体中每条日志一行(NDJSON).
+// 每行的内容可以是原始日志, JSON信封或者Go模板生成的文本
+type httpLogger struct {
+	client      *http.Client
+	url         string
+	method      string
+	headers     http.Header
+	contentType string
+	gzip        bool
+	format      string
+	tmpl        *template.Template
+	success     [][2]int /*表示成功的状态码范围*/
+	hostname    string
+	extra       map[string]interface{}
+	retry       *retryPolicy
+	batch       *batcher
+}
+
+// httpTemplateData http-template中可以使用的字段
+type httpTemplateData struct {
+	Line      string
+	Source    string
+	Timestamp time.Time
+	Attrs     map[string]string
+	Extra     map[string]interface{}
+	Host      string
+}
+
+// NewHTTP creates a http logger. The supported log opts are http-url, http-method,
+// http-headers, http-gzip, http-format, http-template, http-content-type,
+// http-success-status, http-batch-size, http-batch-bytes, http-flush-interval,
+// http-max-retries and the http client options.
+func NewHTTP(info logger.Info) (logger.Logger, error) {
+	cfg := info.Config
+
+	if cfg["http-url"] == "" {
+		return nil, fmt.Errorf("http: http-url is a required parameter")
+	}
+	if _, err := url.ParseRequestURI(cfg["http-url"]); err != nil {
+		return nil, fmt.Errorf("http: invalid http-url %q: %v", cfg["http-url"], err)
+	}
+
+	h := &httpLogger{
+		url:     cfg["http-url"],
+		method:  strings.ToUpper(cfg["http-method"]),
+		headers: make(http.Header),
+		format:  cfg["http-format"],
+	}
+	if h.method == "" {
+		h.method = "POST"
+	}
+
+	if v := cfg["http-headers"]; v != "" {
+		for _, kv := range strings.Split(v, ",") {
+			p := strings.SplitN(kv, "=", 2)
+			if len(p) != 2 || strings.TrimSpace(p[0]) == "" {
+				return nil, fmt.Errorf("http: http-headers must be in form k=v,k2=v2, got %q", kv)
+			}
+			h.headers.Add(strings.TrimSpace(p[0]), strings.TrimSpace(p[1]))
+		}
+	}
+
+	var err error
+	if v, ok := cfg["http-gzip"]; ok {
+		if h.gzip, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("http: http-gzip must be true or false")
+		}
+	}
+
+	switch h.format {
+	case "", "json":
+		h.format = "json"
+		h.contentType = "application/x-ndjson"
+	case "raw":
+		h.contentType = "text/plain"
+	case "template":
+		if cfg["http-template"] == "" {
+			return nil, fmt.Errorf("http: http-template is required when http-format is template")
+		}
+		if h.tmpl, err = template.New("http").Parse(cfg["http-template"]); err != nil {
+			return nil, fmt.Errorf("http: invalid http-template: %v", err)
+		}
+		h.contentType = "text/plain"
+	default:
+		return nil, fmt.Errorf("http: unknown http-format %q, must be raw, json or template", h.format)
+	}
+	if v := cfg["http-content-type"]; v != "" {
+		h.contentType = v
+	}
+
+	status := cfg["http-success-status"]
+	if status == "" {
+		status = defaultHTTPSuccess
+	}
+	if h.success, err = parseStatusRanges(status); err != nil {
+		return nil, fmt.Errorf("http: %v", err)
+	}
+
+	if h.client, err = newHTTPClient(cfg, httpName); err != nil {
+		return nil, fmt.Errorf("http: %v", err)
+	}
+
+	if h.hostname, err = info.Hostname(); err != nil {
+		return nil, fmt.Errorf("http: cannot access hostname: %v", err)
+	}
+
+	if h.extra, err = containerExtra(info, ""); err != nil {
+		return nil, err
+	}
+
+	if h.retry, err = newRetryPolicy(cfg, httpName, defaultHTTPRetry, httpRetryInterval); err != nil {
+		return nil, fmt.Errorf("http: %v", err)
+	}
+
+	size, err := parseInt(cfg, "http-batch-size", defaultHTTPBatch)
+	if err != nil {
+		return nil, fmt.Errorf("http: %v", err)
+	}
+	maxBytes, err := parseInt(cfg, "http-batch-bytes", defaultHTTPBytes)
+	if err != nil {
+		return nil, fmt.Errorf("http: %v", err)
+	}
+	interval, err := parseDuration(cfg, "http-flush-interval")
+	if err != nil {
+		return nil, err
+	}
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	h.batch = newBatcher(httpName, size, interval, h.send)
+	h.batch.maxBytes = maxBytes
+	return h, nil
+}
+
+// parseStatusRanges 解析状态码范围, 例如200-299,304
+func parseStatusRanges(v string) ([][2]int, error) {
+	var ranges [][2]int
+	for _, s := range strings.Split(v, ",") {
+		p := strings.SplitN(strings.TrimSpace(s), "-", 2)
+		lo, err := strconv.Atoi(p[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid http-success-status %q", s)
+		}
+		hi := lo
+		if len(p) == 2 {
+			if hi, err = strconv.Atoi(p[1]); err != nil || hi < lo {
+				return nil, fmt.Errorf("invalid http-success-status %q", s)
+			}
+		}
+		ranges = append(ranges, [2]int{lo, hi})
+	}
+	return ranges, nil
+}
+
+func (h *httpLogger) Log(msg *logger.Message) error {
+	err := h.batch.Add(msg)
+	logger.PutMessage(msg)
+	return err
+}
+
+// httpLineEscaper 转义raw和template格式中的换行符, 合并后的多行事件仍然是请求体中的一行
+var httpLineEscaper = strings.NewReplacer("\r", `\r`, "\n", `\n`)
+
+// line 按照http-format生成一条日志对应的行(不包括换行符)
+func (h *httpLogger) line(msg *logger.Message) ([]byte, error) {
+	switch h.format {
+	case "raw":
+		return []byte(httpLineEscaper.Replace(string(msg.Line))), nil
+	case "template":
+		var buf bytes.Buffer
+		err := h.tmpl.Execute(&buf, &httpTemplateData{
+			Line:      string(msg.Line),
+			Source:    msg.Source,
+			Timestamp: msg.Timestamp,
+			Attrs:     msg.Attrs,
+			Extra:     h.extra,
+			Host:      h.hostname,
+		})
+		return []byte(httpLineEscaper.Replace(buf.String())), err
+	}
+
+	env := make(map[string]interface{}, len(h.extra)+len(msg.Attrs)+4)
+	for k, v := range h.extra {
+		env[k] = v
+	}
+	for k, v := range msg.Attrs {
+		env[k] = v
+	}
+	env["@timestamp"] = msg.Timestamp.UTC().Format(time.RFC3339Nano)
+	env["message"] = string(msg.Line)
+	env["source"] = msg.Source
+	env["host"] = h.hostname
+	return json.Marshal(env)
+}
+
+// send 发送一批日志, 网络错误, 429和5xx按照重试策略重试, 其它错误不再重试.
+// 无法生成的行(例如模板执行失败)不发送, 作为partialError中不可重试的失败返回
+func (h *httpLogger) send(msgs []*logger.Message) error {
+	var body bytes.Buffer
+	var w io.Writer = &body
+	var zw *gzip.Writer
+	if h.gzip {
+		zw = gzip.NewWriter(&body)
+		w = zw
+	}
+	var failed []deliveryFailure
+	sent := make([]*logger.Message, 0, len(msgs))
+	for _, m := range msgs {
+		line, err := h.line(m)
+		if err != nil {
+			failed = append(failed, deliveryFailure{
+				msgs: []*logger.Message{m},
+				err:  permanent(fmt.Errorf("http: %v", err)),
+			})
+			continue
+		}
+		w.Write(line)
+		w.Write([]byte{'\n'})
+		sent = append(sent, m)
+	}
+	if len(sent) == 0 {
+		return failed[0].err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("http: %v", err)
+		}
+	}
+
+	err := h.retry.do(httpName, func() error {
+		retry, err := h.post(body.Bytes())
+		if err != nil && !retry {
+			return permanent(err)
+		}
+		return err
+	})
+	if len(failed) == 0 {
+		return err
+	}
+	if err != nil {
+		failed = append(failed, deliveryFailure{msgs: sent, err: err})
+	}
+	return &partialError{failures: failed}
+}
+
+// post 发送一次请求, 返回的bool表示错误是否可以重试
+func (h *httpLogger) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(h.method, h.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range h.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", h.contentType)
+	if h.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	for _, r := range h.success {
+		if resp.StatusCode >= r[0] && resp.StatusCode <= r[1] {
+			io.Copy(ioutil.Discard, resp.Body)
+			return false, nil
+		}
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+}
+
+func (h *httpLogger) Close() error {
+	return h.batch.Close()
+}
+
+func (h *httpLogger) batches() *batcher {
+	return h.batch
+}
+
+func (h *httpLogger) Name() string {
+	return httpName
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+func newTestHTTP(t *testing.T, url string, cfg map[string]string) *httpLogger {
+	cfg["http-url"] = url
+	cfg["retry-base-backoff"] = "1ms"
+	l, err := NewHTTP(logger.Info{
+		ContainerID:   "0123456789abcdef0123456789abcdef",
+		ContainerName: "/web",
+		Config:        cfg,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.(*httpLogger)
+}
+
+func testMessages(lines ...string) []*logger.Message {
+	var msgs []*logger.Message
+	for _, line := range lines {
+		msgs = append(msgs, &logger.Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()})
+	}
+	return msgs
+}
+
+// TestHTTPEscapeNewlines raw和template格式中多行事件的换行符被转义, 每个事件仍然是一行
+func TestHTTPEscapeNewlines(t *testing.T) {
+	bodies := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(b)
+	}))
+	defer srv.Close()
+
+	for format, want := range map[string]string{
+		"raw":      "panic: boom\\n\tat main.go:12\\r\nsecond\n",
+		"template": "stdout panic: boom\\n\tat main.go:12\\r\nstdout second\n",
+	} {
+		h := newTestHTTP(t, srv.URL, map[string]string{
+			"http-format":   format,
+			"http-template": "{{.Source}} {{.Line}}",
+		})
+		if err := h.send(testMessages("panic: boom\n\tat main.go:12\r", "second")); err != nil {
+			t.Fatal(err)
+		}
+		h.Close()
+		if got := <-bodies; got != want {
+			t.Errorf("%s: got %q, want %q", format, got, want)
+		}
+	}
+}
+
+// TestHTTPTemplateFailure 模板执行失败的事件单独作为不可重试的失败, 其它事件正常发送
+func TestHTTPTemplateFailure(t *testing.T) {
+	bodies := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(b)
+	}))
+	defer srv.Close()
+
+	h := newTestHTTP(t, srv.URL, map[string]string{
+		"http-format":   "template",
+		"http-template": `{{if eq .Line "bad"}}{{template "missing"}}{{end}}{{.Line}}`,
+	})
+	defer h.Close()
+
+	msgs := testMessages("first", "bad", "last")
+	pe, ok := h.send(msgs).(*partialError)
+	if !ok {
+		t.Fatal("want a partialError")
+	}
+	if len(pe.failures) != 1 || len(pe.failures[0].msgs) != 1 || pe.failures[0].msgs[0] != msgs[1] {
+		t.Fatalf("unexpected failures %v", pe)
+	}
+	if !isPermanent(pe.failures[0].err) {
+		t.Errorf("template failure %v is retriable", pe.failures[0].err)
+	}
+	if got := <-bodies; got != "first\nlast\n" {
+		t.Errorf("got body %q", got)
+	}
+
+	// 所有事件都失败时不发送请求
+	if err := h.send(testMessages("bad")); !isPermanent(err) || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("got %v, want a permanent template error", err)
+	}
+	select {
+	case b := <-bodies:
+		t.Errorf("unexpected request %q", b)
+	default:
+	}
+}
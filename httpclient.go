@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/docker/go-connections/tlsconfig"
+)
+
+const defaultHTTPTimeout = 30 * time.Second
+
+// newHTTPClient 创建http类driver使用的client, 支持的参数(prefix为driver名称):
+// <prefix>-timeout, <prefix>-tls-ca-cert, <prefix>-tls-cert, <prefix>-tls-key, <prefix>-tls-skip-verify
+func newHTTPClient(cfg map[string]string, prefix string) (*http.Client, error) {
+	timeout, err := parseDuration(cfg, prefix+"-timeout")
+	if err != nil {
+		return nil, err
+	}
+	if timeout == 0 {
+		timeout = defaultHTTPTimeout
+	}
+
+	opts := tlsconfig.Options{
+		CAFile:   cfg[prefix+"-tls-ca-cert"],
+		CertFile: cfg[prefix+"-tls-cert"],
+		KeyFile:  cfg[prefix+"-tls-key"],
+	}
+	if v, ok := cfg[prefix+"-tls-skip-verify"]; ok {
+		if opts.InsecureSkipVerify, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("%s-tls-skip-verify must be true or false", prefix)
+		}
+	}
+	tlsConfig, err := tlsconfig.Client(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// parseInt 解析整数类型的参数, 未设置时返回def
+func parseInt(cfg map[string]string, key string, def int) (int, error) {
+	v, ok := cfg[key]
+	if !ok || v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%s must be a positive integer, got %q", key, v)
+	}
+	return i, nil
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	kafkaName            = "kafka"
+	kafkaClientID        = "logchain"
+	defaultKafkaTopic    = "logs"
+	defaultKafkaKey      = "{{.ContainerID}}"
+	defaultKafkaBatch    = 100
+	defaultKafkaLinger   = 100 * time.Millisecond
+	defaultKafkaTimeout  = 10 * time.Second
+	defaultKafkaRetry    = 1
+	kafkaRetryInterval   = 100 * time.Millisecond
+	kafkaMaxResponseSize = 100 << 20
+
+	kafkaAPIProduce  = 0
+	kafkaAPIMetadata = 3
+
+	kafkaCompressionNone   = 0
+	kafkaCompressionGzip   = 1
+	kafkaCompressionSnappy = 2
+	kafkaCompressionLZ4    = 3
+)
+
+var (
+	kafkaCompressions = map[string]int16{
+		"":       kafkaCompressionNone,
+		"none":   kafkaCompressionNone,
+		"gzip":   kafkaCompressionGzip,
+		"snappy": kafkaCompressionSnappy,
+		"lz4":    kafkaCompressionLZ4,
+	}
+
+	kafkaAcks = map[string]int16{
+		"0":   0,
+		"1":   1,
+		"all": -1,
+		"-1":  -1,
+	}
+
+	// kafkaRetriable 需要刷新metadata后重试的错误码
+	kafkaRetriable = map[int16]string{
+		3:  "UNKNOWN_TOPIC_OR_PARTITION",
+		5:  "LEADER_NOT_AVAILABLE",
+		6:  "NOT_LEADER_FOR_PARTITION",
+		7:  "REQUEST_TIMED_OUT",
+		13: "NETWORK_EXCEPTION",
+		19: "NOT_ENOUGH_REPLICAS",
+		20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	}
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// kafkaLogger 使用Produce API(v3, RecordBatch v2)直接写入Kafka.
+// 默认使用容器ID作为key, 按照Java客户端相同的murmur2算法选择partition, 保证同一个容器的日志有序
+type kafkaLogger struct {
+	mu          sync.Mutex
+	bootstrap   []string
+	brokers     map[int32]string
+	conns       map[string]*kafkaConn
+	topics      map[string]*kafkaTopic
+	topic       *nameTemplate
+	key         *nameTemplate /*为nil时没有key*/
+	acks        int16
+	compression int16
+	timeout     time.Duration
+	hostname    string
+	extra       map[string]interface{}
+	retry       *retryPolicy
+	correlation int32
+	next        int32 /*没有key时轮流使用partition*/
+	batch       *batcher
+}
+
+// kafkaTopic topic的partition以及每个partition的leader
+type kafkaTopic struct {
+	partitions []int32         /*按照id排序*/
+	leaders    map[int32]int32 /*partition id到leader的node id*/
+}
+
+type kafkaConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewKafka creates a kafka logger. The supported log opts are kafka-brokers, kafka-topic,
+// kafka-key, kafka-acks, kafka-compression, kafka-batch-size, kafka-linger and kafka-timeout.
+func NewKafka(info logger.Info) (logger.Logger, error) {
+	cfg := info.Config
+
+	if cfg["kafka-brokers"] == "" {
+		return nil, fmt.Errorf("kafka: kafka-brokers is a required parameter")
+	}
+
+	k := &kafkaLogger{
+		brokers: make(map[int32]string),
+		conns:   make(map[string]*kafkaConn),
+		topics:  make(map[string]*kafkaTopic),
+		acks:    1,
+		timeout: defaultKafkaTimeout,
+	}
+
+	for _, b := range strings.Split(cfg["kafka-brokers"], ",") {
+		b = strings.TrimSpace(b)
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			return nil, fmt.Errorf("kafka: please provide kafka-brokers as host:port,host2:port2, got %q", b)
+		}
+		k.bootstrap = append(k.bootstrap, b)
+	}
+
+	tmpl := cfg["kafka-topic"]
+	if tmpl == "" {
+		tmpl = defaultKafkaTopic
+	}
+	var err error
+	if k.topic, err = newNameTemplate(tmpl, info); err != nil {
+		return nil, fmt.Errorf("kafka: %v", err)
+	}
+
+	keyTmpl, ok := cfg["kafka-key"]
+	if !ok {
+		keyTmpl = defaultKafkaKey
+	}
+	if keyTmpl != "" {
+		if k.key, err = newNameTemplate(keyTmpl, info); err != nil {
+			return nil, fmt.Errorf("kafka: %v", err)
+		}
+	}
+
+	if v, ok := cfg["kafka-acks"]; ok {
+		if k.acks, ok = kafkaAcks[v]; !ok {
+			return nil, fmt.Errorf("kafka: kafka-acks must be 0, 1 or all, got %q", v)
+		}
+	}
+
+	if k.compression, ok = kafkaCompressions[cfg["kafka-compression"]]; !ok {
+		return nil, fmt.Errorf("kafka: kafka-compression must be none, gzip, snappy or lz4, got %q", cfg["kafka-compression"])
+	}
+
+	if d, err := parseDuration(cfg, "kafka-timeout"); err != nil {
+		return nil, err
+	} else if d > 0 {
+		k.timeout = d
+	}
+
+	if k.hostname, err = info.Hostname(); err != nil {
+		return nil, fmt.Errorf("kafka: cannot access hostname: %v", err)
+	}
+
+	if k.extra, err = containerExtra(info, ""); err != nil {
+		return nil, err
+	}
+
+	if k.retry, err = newRetryPolicy(cfg, kafkaName, defaultKafkaRetry, kafkaRetryInterval); err != nil {
+		return nil, fmt.Errorf("kafka: %v", err)
+	}
+
+	size, err := parseInt(cfg, "kafka-batch-size", defaultKafkaBatch)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: %v", err)
+	}
+	linger, err := parseDuration(cfg, "kafka-linger")
+	if err != nil {
+		return nil, err
+	}
+	if linger == 0 {
+		linger = defaultKafkaLinger
+	}
+
+	k.batch = newBatcher(kafkaName, size, linger, k.send)
+	return k, nil
+}
+
+func (k *kafkaLogger) Log(msg *logger.Message) error {
+	err := k.batch.Add(msg)
+	logger.PutMessage(msg)
+	return err
+}
+
+// envelope 生成消息的JSON内容, 字段与GELF的附加字段相同
+func (k *kafkaLogger) envelope(msg *logger.Message) ([]byte, error) {
+	env := make(map[string]interface{}, len(k.extra)+len(msg.Attrs)+4)
+	for key, v := range k.extra {
+		env[key] = v
+	}
+	for key, v := range msg.Attrs {
+		env[key] = v
+	}
+	env["@timestamp"] = msg.Timestamp.UTC().Format(time.RFC3339Nano)
+	env["message"] = string(msg.Line)
+	env["source"] = msg.Source
+	env["host"] = k.hostname
+	return json.Marshal(env)
+}
+
+// kafkaGroup topic和key相同的消息, 作为一个RecordBatch发送给一个partition
+type kafkaGroup struct {
+	topic string
+	key   []byte
+	msgs  []*logger.Message
+}
+
+// send 按照每个消息的时间生成topic和key并分组后发送, 遇到leader变化等错误时刷新metadata后按照重试策略重试
+func (k *kafkaLogger) send(msgs []*logger.Message) error {
+	var groups []*kafkaGroup
+	byName := make(map[string]*kafkaGroup)
+	for _, m := range msgs {
+		t := k.topic.Name(m.Timestamp)
+		var key []byte
+		if k.key != nil {
+			if name := k.key.Name(m.Timestamp); name != "" {
+				key = []byte(name)
+			}
+		}
+		id := t + "\x00" + string(key)
+		g, ok := byName[id]
+		if !ok {
+			g = &kafkaGroup{topic: t, key: key}
+			byName[id] = g
+			groups = append(groups, g)
+		}
+		g.msgs = append(g.msgs, m)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, g := range groups {
+		batch, err := k.recordBatch(g.msgs, g.key)
+		if err != nil {
+			return permanent(fmt.Errorf("kafka: %v", err))
+		}
+		t := g.topic
+		err = k.retry.do(kafkaName, func() error {
+			err := k.produce(t, g.key, batch)
+			if err != nil && !isPermanent(err) {
+				k.reset(t)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reset 丢弃topic的metadata和所有连接, 下次发送时重新获取
+func (k *kafkaLogger) reset(topic string) {
+	delete(k.topics, topic)
+	for addr, c := range k.conns {
+		c.conn.Close()
+		delete(k.conns, addr)
+	}
+}
+
+// produce 将batch发送给key对应的partition, key为nil时轮流使用partition
+func (k *kafkaLogger) produce(topic string, key, batch []byte) error {
+	meta, err := k.metadata(topic)
+	if err != nil {
+		return err
+	}
+
+	var partition int32
+	n := int32(len(meta.partitions))
+	if key != nil {
+		partition = meta.partitions[int32(murmur2(key)&0x7fffffff)%n]
+	} else {
+		partition = meta.partitions[k.next%n]
+		k.next = (k.next + 1) & 0x7fffffff
+	}
+	addr, ok := k.brokers[meta.leaders[partition]]
+	if !ok {
+		return fmt.Errorf("no leader for partition %d", partition)
+	}
+
+	var req kafkaEncoder
+	req.putInt16(-1) // transactional_id
+	req.putInt16(k.acks)
+	req.putInt32(int32(k.timeout / time.Millisecond))
+	req.putInt32(1)
+	req.putString(topic)
+	req.putInt32(1)
+	req.putInt32(partition)
+	req.putBytes(batch)
+
+	resp, err := k.request(addr, kafkaAPIProduce, 3, req.b, k.acks != 0)
+	if err != nil || k.acks == 0 {
+		return err
+	}
+
+	// [topic [partition error_code base_offset log_append_time]] throttle_time
+	for n := resp.getInt32(); n > 0 && resp.err == nil; n-- {
+		resp.getString()
+		for p := resp.getInt32(); p > 0 && resp.err == nil; p-- {
+			resp.getInt32()
+			code := resp.getInt16()
+			resp.getInt64()
+			resp.getInt64()
+			if code != 0 {
+				if name, ok := kafkaRetriable[code]; ok {
+					return fmt.Errorf("cannot produce to topic %s: %s", topic, name)
+				}
+				return permanent(fmt.Errorf("cannot produce to topic %s: error code %d", topic, code))
+			}
+		}
+	}
+	return resp.err
+}
+
+// metadata 返回topic的partition和每个partition的leader
+func (k *kafkaLogger) metadata(topic string) (*kafkaTopic, error) {
+	if meta, ok := k.topics[topic]; ok {
+		return meta, nil
+	}
+
+	var req kafkaEncoder
+	req.putInt32(1)
+	req.putString(topic)
+
+	var resp *kafkaDecoder
+	var err error
+	for _, addr := range k.bootstrap {
+		if resp, err = k.request(addr, kafkaAPIMetadata, 1, req.b, true); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// brokers [node_id host port rack]
+	for n := resp.getInt32(); n > 0 && resp.err == nil; n-- {
+		id := resp.getInt32()
+		host := resp.getString()
+		port := resp.getInt32()
+		resp.getString()
+		k.brokers[id] = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+	resp.getInt32() // controller_id
+
+	// topics [error_code name is_internal [error_code partition leader replicas isr]]
+	var meta *kafkaTopic
+	for n := resp.getInt32(); n > 0 && resp.err == nil; n-- {
+		code := resp.getInt16()
+		name := resp.getString()
+		resp.getInt8()
+		partitions := make(map[int32]int32)
+		for p := resp.getInt32(); p > 0 && resp.err == nil; p-- {
+			resp.getInt16()
+			id := resp.getInt32()
+			partitions[id] = resp.getInt32()
+			resp.getInt32Array()
+			resp.getInt32Array()
+		}
+		if name != topic {
+			continue
+		}
+		if code != 0 {
+			return nil, fmt.Errorf("metadata error code %d for topic %s", code, topic)
+		}
+		meta = &kafkaTopic{leaders: partitions}
+		for id := range partitions {
+			meta.partitions = append(meta.partitions, id)
+		}
+		sort.Slice(meta.partitions, func(i, j int) bool { return meta.partitions[i] < meta.partitions[j] })
+	}
+	if resp.err != nil {
+		return nil, resp.err
+	}
+	if meta == nil || len(meta.partitions) == 0 {
+		return nil, fmt.Errorf("topic %s has no partitions", topic)
+	}
+
+	k.topics[topic] = meta
+	return meta, nil
+}
+
+// request 发送一个请求, wait为false时(acks=0的Produce)不读取响应
+func (k *kafkaLogger) request(addr string, api, version int16, body []byte, wait bool) (*kafkaDecoder, error) {
+	c, ok := k.conns[addr]
+	if !ok {
+		conn, err := net.DialTimeout("tcp", addr, k.timeout)
+		if err != nil {
+			return nil, err
+		}
+		c = &kafkaConn{conn: conn, r: bufio.NewReader(conn)}
+		k.conns[addr] = c
+	}
+
+	k.correlation++
+	var req kafkaEncoder
+	req.putInt32(0) // size
+	req.putInt16(api)
+	req.putInt16(version)
+	req.putInt32(k.correlation)
+	req.putString(kafkaClientID)
+	req.b = append(req.b, body...)
+	binary.BigEndian.PutUint32(req.b, uint32(len(req.b)-4))
+
+	c.conn.SetDeadline(time.Now().Add(k.timeout))
+	if _, err := c.conn.Write(req.b); err != nil {
+		return nil, err
+	}
+	if !wait {
+		return nil, nil
+	}
+
+	var head [8]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(head[:4])
+	if size < 4 || size > kafkaMaxResponseSize {
+		return nil, fmt.Errorf("invalid response size %d", size)
+	}
+	if id := int32(binary.BigEndian.Uint32(head[4:])); id != k.correlation {
+		return nil, fmt.Errorf("unexpected correlation id %d, want %d", id, k.correlation)
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, err
+	}
+	return &kafkaDecoder{b: resp}, nil
+}
+
+// recordBatch 按照RecordBatch v2(magic 2)编码一批消息, 每个record使用相同的key
+func (k *kafkaLogger) recordBatch(msgs []*logger.Message, key []byte) ([]byte, error) {
+	first := msgs[0].Timestamp.UnixNano() / int64(time.Millisecond)
+	max := first
+
+	var records []byte
+	for i, m := range msgs {
+		value, err := k.envelope(m)
+		if err != nil {
+			return nil, err
+		}
+		ts := m.Timestamp.UnixNano() / int64(time.Millisecond)
+		if ts > max {
+			max = ts
+		}
+
+		var r kafkaEncoder
+		r.b = append(r.b, 0) // attributes
+		r.putVarint(ts - first)
+		r.putVarint(int64(i))
+		if key == nil {
+			r.putVarint(-1)
+		} else {
+			r.putVarint(int64(len(key)))
+			r.b = append(r.b, key...)
+		}
+		r.putVarint(int64(len(value)))
+		r.b = append(r.b, value...)
+		r.putVarint(0) // headers
+
+		var e kafkaEncoder
+		e.putVarint(int64(len(r.b)))
+		records = append(records, e.b...)
+		records = append(records, r.b...)
+	}
+
+	switch k.compression {
+	case kafkaCompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(records)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		records = buf.Bytes()
+	case kafkaCompressionSnappy:
+		records = encodeXerialSnappy(records)
+	case kafkaCompressionLZ4:
+		records = encodeLZ4Frame(records)
+	}
+
+	// crc之后的部分
+	var body kafkaEncoder
+	body.putInt16(k.compression)
+	body.putInt32(int32(len(msgs) - 1))
+	body.putInt64(first)
+	body.putInt64(max)
+	body.putInt64(-1) // producer_id
+	body.putInt16(-1) // producer_epoch
+	body.putInt32(-1) // base_sequence
+	body.putInt32(int32(len(msgs)))
+	body.b = append(body.b, records...)
+
+	var batch kafkaEncoder
+	batch.putInt64(0)                              // base_offset
+	batch.putInt32(int32(4 + 1 + 4 + len(body.b))) // length
+	batch.putInt32(-1)                             // partition_leader_epoch
+	batch.b = append(batch.b, 2)                   // magic
+	batch.putInt32(int32(crc32.Checksum(body.b, crc32c)))
+	batch.b = append(batch.b, body.b...)
+	return batch.b, nil
+}
+
+func (k *kafkaLogger) Close() error {
+	err := k.batch.Close()
+	k.mu.Lock()
+	for addr, c := range k.conns {
+		c.conn.Close()
+		delete(k.conns, addr)
+	}
+	k.mu.Unlock()
+	return err
+}
+
+func (k *kafkaLogger) batches() *batcher {
+	return k.batch
+}
+
+func (k *kafkaLogger) Name() string {
+	return kafkaName
+}
+
+// xerialHeader Java客户端使用的snappy-java(xerial)的stream格式的header
+var xerialHeader = []byte{0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0, 0, 0, 0, 1, 0, 0, 0, 1}
+
+// encodeXerialSnappy 按照xerial格式压缩: header之后是若干个[int32 长度][snappy block], 每块最多32K
+func encodeXerialSnappy(src []byte) []byte {
+	dst := append([]byte(nil), xerialHeader...)
+	for len(src) > 0 {
+		chunk := src
+		if len(chunk) > 32<<10 {
+			chunk = chunk[:32<<10]
+		}
+		src = src[len(chunk):]
+		block := encodeSnappy(chunk)
+		dst = appendUint32(dst, uint32(len(block)))
+		dst = append(dst, block...)
+	}
+	return dst
+}
+
+// murmur2 与Kafka Java客户端的Utils.murmur2相同, 用于按照key选择partition
+func murmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := length &^ 3
+	switch length % 4 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// kafkaEncoder Kafka协议的编码, 所有整数都是big endian
+type kafkaEncoder struct {
+	b []byte
+}
+
+func (e *kafkaEncoder) putInt16(v int16) {
+	e.b = append(e.b, byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) putInt32(v int32) {
+	e.b = appendUint32(e.b, uint32(v))
+}
+
+func (e *kafkaEncoder) putInt64(v int64) {
+	e.b = appendUint64(e.b, uint64(v))
+}
+
+func (e *kafkaEncoder) putString(s string) {
+	e.putInt16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *kafkaEncoder) putBytes(p []byte) {
+	e.putInt32(int32(len(p)))
+	e.b = append(e.b, p...)
+}
+
+// putVarint zigzag编码的varint, 用于RecordBatch中的record
+func (e *kafkaEncoder) putVarint(v int64) {
+	var p [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(p[:], v)
+	e.b = append(e.b, p[:n]...)
+}
+
+// kafkaDecoder Kafka协议的解码, 出错后记录在err中, 之后的读取都返回零值
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.b) < n {
+		d.err = errors.New("kafka: malformed response")
+		return nil
+	}
+	p := d.b[:n]
+	d.b = d.b[n:]
+	return p
+}
+
+func (d *kafkaDecoder) getInt8() int8 {
+	if p := d.next(1); p != nil {
+		return int8(p[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) getInt16() int16 {
+	if p := d.next(2); p != nil {
+		return int16(binary.BigEndian.Uint16(p))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) getInt32() int32 {
+	if p := d.next(4); p != nil {
+		return int32(binary.BigEndian.Uint32(p))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) getInt64() int64 {
+	if p := d.next(8); p != nil {
+		return int64(binary.BigEndian.Uint64(p))
+	}
+	return 0
+}
+
+// getString 读取string或者nullable string(长度为-1时返回空字符串)
+func (d *kafkaDecoder) getString() string {
+	n := d.getInt16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *kafkaDecoder) getInt32Array() []int32 {
+	n := d.getInt32()
+	var a []int32
+	for ; n > 0 && d.err == nil; n-- {
+		a = append(a, d.getInt32())
+	}
+	return a
+}
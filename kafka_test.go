@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// fakeBroker 只实现Metadata v1和Produce v3的broker, 收到的Produce请求的partition发送到produced,
+// topic和RecordBatch发送到batches
+type fakeBroker struct {
+	l          net.Listener
+	topic      string
+	partitions map[int32]int32 /*partition id到leader的node id, 按照map的顺序返回*/
+	produced   chan int32
+	batches    chan producedBatch
+}
+
+// producedBatch Produce请求中的一个RecordBatch
+type producedBatch struct {
+	topic string
+	batch []byte
+}
+
+func newFakeBroker(t *testing.T, topic string, partitions map[int32]int32) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{l: l, topic: topic, partitions: partitions, produced: make(chan int32, 16), batches: make(chan producedBatch, 16)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		req := &kafkaDecoder{b: make([]byte, binary.BigEndian.Uint32(size[:]))}
+		if _, err := io.ReadFull(r, req.b); err != nil {
+			return
+		}
+		api := req.getInt16()
+		req.getInt16() // version
+		correlation := req.getInt32()
+		req.getString() // client_id
+
+		var resp kafkaEncoder
+		resp.putInt32(0)
+		resp.putInt32(correlation)
+		switch api {
+		case kafkaAPIMetadata:
+			host, port, _ := net.SplitHostPort(b.l.Addr().String())
+			p, _ := strconv.Atoi(port)
+			nodes := make(map[int32]bool)
+			for _, leader := range b.partitions {
+				nodes[leader] = true
+			}
+			resp.putInt32(int32(len(nodes)))
+			for id := range nodes {
+				resp.putInt32(id)
+				resp.putString(host)
+				resp.putInt32(int32(p))
+				resp.putInt16(-1) // rack
+			}
+			resp.putInt32(1) // controller_id
+			resp.putInt32(1)
+			resp.putInt16(0)
+			resp.putString(b.topic)
+			resp.b = append(resp.b, 0) // is_internal
+			resp.putInt32(int32(len(b.partitions)))
+			for id, leader := range b.partitions {
+				resp.putInt16(0)
+				resp.putInt32(id)
+				resp.putInt32(leader)
+				resp.putInt32(1)
+				resp.putInt32(leader) // replicas
+				resp.putInt32(1)
+				resp.putInt32(leader) // isr
+			}
+		case kafkaAPIProduce:
+			req.getInt16() // transactional_id
+			req.getInt16() // acks
+			req.getInt32() // timeout
+			req.getInt32()
+			topic := req.getString()
+			req.getInt32()
+			partition := req.getInt32()
+			batch := req.next(int(req.getInt32()))
+			if req.err != nil {
+				return
+			}
+			b.produced <- partition
+			select {
+			case b.batches <- producedBatch{topic, append([]byte(nil), batch...)}:
+			default:
+			}
+
+			resp.putInt32(1)
+			resp.putString(topic)
+			resp.putInt32(1)
+			resp.putInt32(partition)
+			resp.putInt16(0)
+			resp.putInt64(0)
+			resp.putInt64(-1)
+			resp.putInt32(0) // throttle_time
+		default:
+			return
+		}
+		binary.BigEndian.PutUint32(resp.b, uint32(len(resp.b)-4))
+		if _, err := conn.Write(resp.b); err != nil {
+			return
+		}
+	}
+}
+
+// TestKafkaPartitions partition的id不连续时, 按照排序后的id选择partition并发送给它的leader
+func TestKafkaPartitions(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef"
+	for name, partitions := range map[string]map[int32]int32{
+		"contiguous": {2: 1, 0: 2, 1: 3},
+		"gaps":       {0: 1, 5: 2, 9: 3},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := newFakeBroker(t, "logs", partitions)
+			defer b.l.Close()
+
+			sorted := map[string][]int32{"contiguous": {0, 1, 2}, "gaps": {0, 5, 9}}[name]
+			keyed := sorted[murmur2([]byte(id))&0x7fffffff%uint32(len(sorted))]
+
+			for _, key := range []string{"{{.ContainerID}}", ""} {
+				l, err := NewKafka(logger.Info{
+					ContainerID:   id,
+					ContainerName: "/web",
+					Config: map[string]string{
+						"kafka-brokers":    b.l.Addr().String(),
+						"kafka-key":        key,
+						"kafka-batch-size": "1",
+					},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < len(sorted); i++ {
+					m := logger.NewMessage()
+					m.Line = []byte("line " + strconv.Itoa(i))
+					m.Timestamp = time.Now()
+					if err := l.Log(m); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := l.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				for i := 0; i < len(sorted); i++ {
+					want := keyed
+					if key == "" {
+						want = sorted[i]
+					}
+					select {
+					case got := <-b.produced:
+						if got != want {
+							t.Errorf("key %q: message %d produced to partition %d, want %d", key, i, got, want)
+						}
+					case <-time.After(5 * time.Second):
+						t.Fatalf("key %q: message %d not produced", key, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+// kafkaRecord RecordBatch中的一个record
+type kafkaRecord struct {
+	key   []byte
+	value []byte
+}
+
+// decodeRecordBatch 解码RecordBatch v2, 检查crc并按照attributes解压records
+func decodeRecordBatch(b []byte) (int16, []kafkaRecord, error) {
+	d := &kafkaDecoder{b: b}
+	d.getInt64() // base_offset
+	if n := d.getInt32(); int(n) != len(d.b) {
+		return 0, nil, fmt.Errorf("batch length %d, got %d bytes", n, len(d.b))
+	}
+	d.getInt32() // partition_leader_epoch
+	if magic := d.getInt8(); magic != 2 {
+		return 0, nil, fmt.Errorf("magic %d", magic)
+	}
+	if crc := uint32(d.getInt32()); crc != crc32.Checksum(d.b, crc32c) {
+		return 0, nil, fmt.Errorf("crc mismatch")
+	}
+	codec := d.getInt16() & 7
+	d.getInt32() // last_offset_delta
+	d.getInt64() // first_timestamp
+	d.getInt64() // max_timestamp
+	d.getInt64() // producer_id
+	d.getInt16() // producer_epoch
+	d.getInt32() // base_sequence
+	count := int(d.getInt32())
+	if d.err != nil {
+		return 0, nil, d.err
+	}
+
+	records := d.b
+	var err error
+	switch codec {
+	case kafkaCompressionGzip:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(records)); err == nil {
+			records, err = ioutil.ReadAll(r)
+		}
+	case kafkaCompressionSnappy:
+		records, err = decodeXerialSnappy(records)
+	case kafkaCompressionLZ4:
+		records, err = decodeLZ4Frame(records)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	varint := func() int64 {
+		v, n := binary.Varint(records)
+		if n <= 0 {
+			err = fmt.Errorf("invalid varint")
+			return 0
+		}
+		records = records[n:]
+		return v
+	}
+	bytesField := func() []byte {
+		n := varint()
+		if n < 0 || err != nil {
+			return nil
+		}
+		if int64(len(records)) < n {
+			err = fmt.Errorf("truncated record")
+			return nil
+		}
+		p := records[:n]
+		records = records[n:]
+		return p
+	}
+	var out []kafkaRecord
+	for i := 0; i < count && err == nil; i++ {
+		varint()              // length
+		records = records[1:] // attributes
+		varint()              // timestamp_delta
+		if delta := varint(); delta != int64(i) {
+			return 0, nil, fmt.Errorf("record %d has offset delta %d", i, delta)
+		}
+		r := kafkaRecord{key: bytesField(), value: bytesField()}
+		varint() // headers
+		out = append(out, r)
+	}
+	if err == nil && len(records) != 0 {
+		err = fmt.Errorf("%d bytes after the records", len(records))
+	}
+	return codec, out, err
+}
+
+// TestKafkaCompression 每种压缩方式的RecordBatch都可以解码, topic和key按照事件的时间生成
+func TestKafkaCompression(t *testing.T) {
+	day := time.Date(2024, 3, 5, 23, 30, 0, 0, time.UTC)
+	for name, codec := range kafkaCompressions {
+		t.Run(name, func(t *testing.T) {
+			b := newFakeBroker(t, "logs-2024.03.05", map[int32]int32{0: 1, 1: 1})
+			defer b.l.Close()
+
+			l, err := NewKafka(logger.Info{
+				ContainerID:   "0123456789abcdef0123456789abcdef",
+				ContainerName: "/web",
+				Config: map[string]string{
+					"kafka-brokers":     b.l.Addr().String(),
+					"kafka-topic":       "logs-2006.01.02",
+					"kafka-key":         "{{.ContainerName}}-2006.01",
+					"kafka-compression": name,
+					"kafka-batch-size":  "3",
+					"kafka-linger":      "1h",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				m := logger.NewMessage()
+				m.Line = bytes.Repeat([]byte("line "+strconv.Itoa(i)+" "), 20)
+				m.Source = "stdout"
+				m.Timestamp = day.Add(time.Duration(i) * time.Second)
+				if err := l.Log(m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var p producedBatch
+			select {
+			case p = <-b.batches:
+			case <-time.After(5 * time.Second):
+				t.Fatal("nothing produced")
+			}
+			if p.topic != "logs-2024.03.05" {
+				t.Errorf("produced to topic %q", p.topic)
+			}
+			got, records, err := decodeRecordBatch(p.batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != codec {
+				t.Errorf("got codec %d, want %d", got, codec)
+			}
+			if len(records) != 3 {
+				t.Fatalf("got %d records, want 3", len(records))
+			}
+			for i, r := range records {
+				if string(r.key) != "web-2024.03" {
+					t.Errorf("record %d: key %q", i, r.key)
+				}
+				var env map[string]interface{}
+				if err := json.Unmarshal(r.value, &env); err != nil {
+					t.Fatalf("record %d: %v", i, err)
+				}
+				if want := string(bytes.Repeat([]byte("line "+strconv.Itoa(i)+" "), 20)); env["message"] != want || env["source"] != "stdout" {
+					t.Errorf("record %d: unexpected envelope %v", i, env)
+				}
+			}
+		})
+	}
+}
+
+// TestMurmur2 与Kafka Java客户端UtilsTest.testMurmur2相同的结果
+func TestMurmur2(t *testing.T) {
+	for in, want := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if got := int32(murmur2([]byte(in))); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
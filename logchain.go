@@ -13,51 +13,131 @@ import (
 	"syscall"
 	"github.com/tonistiigi/fifo"
 	"context"
-	"encoding/binary"
-	protoio "github.com/gogo/protobuf/io"
 	"github.com/docker/docker/api/types/plugins/logdriver"
 	"time"
 	"strings"
 	"strconv"
+	"sync/atomic"
+	"github.com/docker/go-units"
+	"github.com/Sirupsen/logrus"
 )
 
 type LogChain struct {
 	mu     sync.Mutex
 	logs   map[string]*logPair
 	idx    map[string]*logPair
-	stop   chan int
 	logger logger.Logger
+
+	closing bool           /*插件正在退出, 不再接受新的容器*/
+	wg      sync.WaitGroup /*正在停止的容器*/
+	conf    *pluginConfig  /*CONFIG_FILE中的配置, 没有配置文件时为nil*/
 }
 
 type logPair struct {
-	jsonl    logger.Logger
-	driver   logger.Logger
-	stream   io.ReadCloser
-	info     logger.Info
-	bufLines int      /*一次缓存的行数*/
-	tempStr  []string /*缓存的日志*/
+	mu        sync.Mutex
+	jsonl     logger.Logger
+	driver    logger.Logger
+	pause     *pauseLogger /*driver中暂停发送的一层, 由admin API控制*/
+	stream    io.ReadCloser
+	dec       *logReader
+	info      logger.Info
+	opts      map[string]string     /*容器自己的log-opt, 重新加载配置文件时使用*/
+	options   map[string]string     /*生效的参数, 由LogChain.mu保护*/
+	bufLines  int                   /*一次缓存的行数*/
+	groups    map[string]*lineGroup /*按stream缓存的日志*/
+	ml        *multiline            /*按正则合并日志, 为nil时按bufLines合并*/
+	dedup     *dedup                /*合并连续重复的事件, 为nil时不合并*/
+	separator string                /*合并日志时使用的分隔符*/
+
+	flushInterval time.Duration /*tempStr空闲超过此时间后直接发送*/
+	maxWait       time.Duration /*tempStr中的事件最长等待时间*/
+	done          chan struct{} /*consumeLog结束时关闭*/
+	stop          chan struct{} /*StopLogging超时后关闭, 通知consumeLog退出*/
+
+	partials   map[string]*logdriver.LogEntry /*按stream缓存的partial片段*/
+	partialMax int                            /*拼接后单行的最大长度*/
+
+	frames     uint64 /*从FIFO读取的LogEntry*/
+	lines      uint64 /*放入tempStr的行*/
+	sent       uint64 /*发送给driver的事件*/
+	sendErrors uint64 /*driver返回错误的事件*/
+	pending    int64  /*所有stream的tempStr中缓存的行*/
 }
 
-var bufMap map[string]logdriver.LogEntry
+const (
+	// defaultPartialMax partial片段拼接后单行的默认最大长度
+	defaultPartialMax = 1 << 20
+	// defaultLogDir 未指定LogPath时本地jsonfile所在的目录
+	defaultLogDir = "/var/log/docker"
+	// stopTimeout StopLogging等待FIFO中剩余日志读取完毕的最长时间
+	stopTimeout = 10 * time.Second
+)
+
+var bufMap = make(map[string]logdriver.LogEntry)
 //var tempStr []string
 
 func (lc *LogChain) Handler(lr logging.LogsRequest) error {
 
 	lc.mu.Lock()
+	if lc.closing {
+		lc.mu.Unlock()
+		return errors.New("logchain is shutting down")
+	}
 	if _, exists := lc.logs[lr.File]; exists {
 		lc.mu.Unlock()
 		return fmt.Errorf("logger for %q already exists", lr.File)
 	}
 	lc.mu.Unlock()
 
+	opts := lr.Info.Config
+	cfg, err := lc.resolveConfig(opts)
+	if err != nil {
+		return errors.Wrap(err, "error applying config file")
+	}
+	lr.Info.Config = cfg
+
 	if lr.Info.LogPath == "" {
-		lr.Info.LogPath = filepath.Join("/var/log/docker", lr.Info.ContainerID)
+		lr.Info.LogPath = filepath.Join(defaultLogDir, lr.Info.ContainerID)
 	}
 
 	if err := os.MkdirAll(filepath.Dir(lr.Info.LogPath), 0755); err != nil {
 		return errors.Wrap(err, "error setting up logger dir")
 	}
 
+	ml, err := newMultiline(lr.Info.Config)
+	if err != nil {
+		return errors.Wrap(err, "error parsing multiline options")
+	}
+
+	separator, err := parseSeparator(lr.Info.Config)
+	if err != nil {
+		return err
+	}
+
+	flushInterval, err := parseDuration(lr.Info.Config, "flush-interval")
+	if err != nil {
+		return err
+	}
+
+	maxWait, err := parseDuration(lr.Info.Config, "max-wait")
+	if err != nil {
+		return err
+	}
+
+	dd, err := newDedup(lr.Info.Config)
+	if err != nil {
+		return errors.Wrap(err, "error parsing dedup options")
+	}
+
+	partialMax := defaultPartialMax
+	if v, ok := lr.Info.Config["partial-max-size"]; ok {
+		size, err := units.RAMInBytes(v)
+		if err != nil || size <= 0 {
+			return fmt.Errorf("partial-max-size must be a positive size like 4m, got %q", v)
+		}
+		partialMax = int(size)
+	}
+
 	jsonl, err := jsonfilelog.New(lr.Info)
 	if err != nil {
 		return errors.Wrap(err, "error creating jsonfile logger")
@@ -65,47 +145,253 @@ func (lc *LogChain) Handler(lr logging.LogsRequest) error {
 
 	log, err := New(lr.Info)
 	if err != nil {
+		jsonl.Close()
 		return errors.Wrap(err, "error creating logger driver")
 	}
 
+	// 之后的错误需要关闭已经创建的driver(包括外层)和jsonl
+	fail := func(err error, msg string) error {
+		log.Close()
+		jsonl.Close()
+		return errors.Wrap(err, msg)
+	}
+
+	l, err := withDelivery(log, lr.Info, log.Name())
+	if err != nil {
+		return fail(err, "error setting up spool or dead-letter")
+	}
+
+	pause := withPause(l)
+	log = pause
+
+	if l, err = withMode(log, lr.Info); err != nil {
+		return fail(err, "error parsing mode options")
+	}
+	log = l
+
+	if l, err = withRateLimit(log, lr.Info); err != nil {
+		return fail(err, "error parsing rate limit options")
+	}
+	log = l
+
 	f, err := fifo.OpenFifo(context.Background(), lr.File, syscall.O_RDONLY, 0700)
 	if err != nil {
-		return errors.Wrapf(err, "error opening logger fifo: %q", lr.File)
+		return fail(err, fmt.Sprintf("error opening logger fifo: %q", lr.File))
 	}
 
 	lc.mu.Lock()
+	// 创建driver期间插件可能开始退出或者相同的FIFO已经启动, Shutdown不会再关闭这个容器
+	if _, exists := lc.logs[lr.File]; lc.closing || exists {
+		lc.mu.Unlock()
+		f.Close()
+		log.Close()
+		jsonl.Close()
+		if exists {
+			return fmt.Errorf("logger for %q already exists", lr.File)
+		}
+		return errors.New("logchain is shutting down")
+	}
 
 	line, err := strconv.Atoi(lr.Info.Config["buf"])
 	if err != nil {
 		line = 1
 	}
 
-	var ts []string
-	lf := &logPair{jsonl, log, f, lr.Info, line, ts}
+	lf := &logPair{
+		jsonl:     jsonl,
+		driver:    log,
+		pause:     pause,
+		stream:    f,
+		dec:       newLogReader(f, logrus.WithField("container", lr.Info.ContainerID)),
+		info:      lr.Info,
+		opts:      opts,
+		options:   lr.Info.Config,
+		bufLines:  line,
+		groups:    make(map[string]*lineGroup),
+		ml:        ml,
+		dedup:     dd,
+		separator: separator,
+
+		flushInterval: flushInterval,
+		maxWait:       maxWait,
+		done:          make(chan struct{}),
+		stop:          make(chan struct{}),
+
+		partials:   make(map[string]*logdriver.LogEntry),
+		partialMax: partialMax,
+	}
 
 	lc.logs[lr.File] = lf
 	lc.idx[lr.Info.ContainerID] = lf
 	lc.mu.Unlock()
 
-	go consumeLog(lf)
 	go func() {
-		select {
-		case <-lc.stop:
-			buf := getLogEntry(lr.Info.ContainerID)
-			buf.Line = append([]byte(strings.Join(lf.tempStr, "\n\r")), buf.Line...)
-			sendMessage(lf.driver, buf, lf.info.ContainerID)
+		if err := consumeLog(lf); err != nil {
+			lc.abandon(lr.File, lf)
 		}
 	}()
+	if lf.flushInterval > 0 || lf.maxWait > 0 || lf.dedup != nil {
+		go lf.flushLoop()
+	}
 	return nil
 }
 
+// ContainerStats 一个容器的统计, Buffer只在mode=non-blocking时存在, RateLimit只在开启限速时存在.
+// Held为暂停期间缓存的事件数, PauseDropped为缓存满后丢弃的事件数. Destinations为driver的每个目标, 没有使用fan-out时只有一个
+type ContainerStats struct {
+	ContainerID   string             `json:"container_id"`
+	ContainerName string             `json:"container_name"`
+	Driver        string             `json:"driver"`
+	Mode          string             `json:"mode"`
+	Frames        uint64             `json:"frames"`
+	Lines         uint64             `json:"lines"`
+	Pending       int64              `json:"pending"`
+	Sent          uint64             `json:"sent"`
+	SendErrors    uint64             `json:"send_errors"`
+	Paused        bool               `json:"paused"`
+	Held          int                `json:"held"`
+	PauseDropped  uint64             `json:"pause_dropped"`
+	Buffer        *BufferStats       `json:"buffer,omitempty"`
+	Decode        DecodeStats        `json:"decode"`
+	RateLimit     *RateLimitStats    `json:"rate_limit,omitempty"`
+	Destinations  []DestinationStats `json:"destinations"`
+}
+
+// Stats 返回每个容器的统计
+func (lc *LogChain) Stats() []ContainerStats {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	stats := make([]ContainerStats, 0, len(lc.idx))
+	for _, lf := range lc.idx {
+		stats = append(stats, lf.stats())
+	}
+	return stats
+}
+
+func (lf *logPair) stats() ContainerStats {
+	s := ContainerStats{
+		ContainerID:   lf.info.ContainerID,
+		ContainerName: lf.info.Name(),
+		Driver:        lf.driver.Name(),
+		Mode:          modeBlocking,
+		Frames:        atomic.LoadUint64(&lf.frames),
+		Lines:         atomic.LoadUint64(&lf.lines),
+		Pending:       atomic.LoadInt64(&lf.pending),
+		Sent:          atomic.LoadUint64(&lf.sent),
+		SendErrors:    atomic.LoadUint64(&lf.sendErrors),
+		Decode:        lf.dec.stats(),
+	}
+	s.Paused, s.Held = lf.pause.state()
+	s.PauseDropped = lf.pause.droppedEvents()
+
+	// driver外层依次为rateLimiter, ringLogger和pauseLogger, 然后是fan-out或者deliveryLogger
+	l := lf.driver
+	if r, ok := l.(*rateLimiter); ok {
+		rs := r.stats()
+		s.RateLimit = &rs
+		l = r.driver
+	}
+	if r, ok := l.(*ringLogger); ok {
+		b := r.stats()
+		s.Mode = modeNonBlocking
+		s.Buffer = &b
+		l = r.driver
+	}
+	if p, ok := l.(*pauseLogger); ok {
+		l = p.driver
+	}
+	switch d := l.(type) {
+	case *fanoutLogger:
+		s.Destinations = d.Stats()
+	case *deliveryLogger:
+		ds := DestinationStats{Name: d.Name(), Driver: d.Name()}
+		d.addStats(&ds)
+		s.Destinations = []DestinationStats{ds}
+	default:
+		s.Destinations = []DestinationStats{{Name: l.Name(), Driver: l.Name(), Sent: s.Sent, Failed: s.SendErrors}}
+	}
+	return s
+}
+
+// HandlerStop 按照FIFO找到容器的logPair, 发送未完成的事件并释放资源
 func (lc *LogChain) HandlerStop(lr logging.LogsRequest) error {
-	lc.stop <- 1
-	return nil
+	lc.mu.Lock()
+	lf, exists := lc.logs[lr.File]
+	if !exists {
+		lc.mu.Unlock()
+		return fmt.Errorf("logger for %q not found", lr.File)
+	}
+	delete(lc.logs, lr.File)
+	if lc.idx[lf.info.ContainerID] == lf {
+		delete(lc.idx, lf.info.ContainerID)
+	}
+	lc.wg.Add(1)
+	defer lc.wg.Done()
+	lc.mu.Unlock()
+
+	return lf.close()
+}
+
+// abandon 读取FIFO失败后像StopLogging一样移除容器并关闭driver和jsonl, 之后的StopLogging找不到容器.
+// 容器已经被StopLogging或者Shutdown移除时不做处理
+func (lc *LogChain) abandon(file string, lf *logPair) {
+	lc.mu.Lock()
+	if lc.logs[file] != lf {
+		lc.mu.Unlock()
+		return
+	}
+	delete(lc.logs, file)
+	if lc.idx[lf.info.ContainerID] == lf {
+		delete(lc.idx, lf.info.ContainerID)
+	}
+	lc.wg.Add(1)
+	defer lc.wg.Done()
+	lc.mu.Unlock()
+
+	if err := lf.closeLoggers(); err != nil {
+		logrus.WithField("container", lf.info.ContainerID).Errorf("error closing logger: %v", err)
+	}
+}
+
+// close 等待consumeLog读完FIFO中剩余的日志并发送未完成的事件, 然后关闭driver和jsonl.
+// Docker在StopLogging之前会关闭FIFO的写入端, 超过stopTimeout仍未结束时主动关闭FIFO
+func (lf *logPair) close() error {
+	// 暂停的容器先恢复发送, 否则consumeLog可能一直等待
+	lf.pause.resume()
+	lf.interrupt(stopTimeout)
+	return lf.closeLoggers()
+}
+
+// interrupt 等待consumeLog读完FIFO(写入端关闭后读到EOF), 超过timeout后关闭FIFO,
+// 等待consumeLog发送未完成的事件后退出
+func (lf *logPair) interrupt(timeout time.Duration) {
+	select {
+	case <-lf.done:
+		return
+	case <-time.After(timeout):
+	}
+	logrus.WithField("container", lf.info.ContainerID).Warnf("log fifo is not closed after %v, closing it", timeout)
+	close(lf.stop)
+	lf.stream.Close()
+	<-lf.done
+}
+
+// closeLoggers 关闭driver和jsonl, driver会发送缓存中剩余的事件
+func (lf *logPair) closeLoggers() error {
+	err := lf.driver.Close()
+	if jerr := lf.jsonl.Close(); jerr != nil && err == nil {
+		err = jerr
+	}
+	return err
 }
 
 func (lc *LogChain) HandlerRead(config logging.LogsReadRequest) (*logger.LogWatcher, error) {
+	lc.mu.Lock()
 	lr := lc.idx[config.Info.ContainerID]
+	lc.mu.Unlock()
+	if lr == nil {
+		return readStopped(config)
+	}
 	if jsReader, ok := lr.jsonl.(logger.LogReader); !ok {
 		return nil, errors.New("Get LogReader Errro")
 	} else {
@@ -113,54 +399,127 @@ func (lc *LogChain) HandlerRead(config logging.LogsReadRequest) (*logger.LogWatc
 	}
 }
 
-func consumeLog(lf *logPair) {
+// readStopped 读取已经停止的容器的本地jsonfile, 读取结束后关闭jsonfile
+func readStopped(config logging.LogsReadRequest) (*logger.LogWatcher, error) {
+	info := config.Info
+	if info.LogPath == "" {
+		info.LogPath = filepath.Join(defaultLogDir, info.ContainerID)
+	}
+	jsonl, err := jsonfilelog.New(info)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening jsonfile logger")
+	}
 
-	dec := protoio.NewUint32DelimitedReader(lf.stream, binary.BigEndian, 1e6)
-	defer dec.Close()
-	buf := getLogEntry(lf.info.ContainerID)
+	cfg := config.Config
+	cfg.Follow = false
+	r := jsonl.(logger.LogReader).ReadLogs(cfg)
 
-	idx := 0
-	for {
-		idx ++
-		if err := dec.ReadMsg(buf); err != nil {
-			if err == io.EOF {
-				fmt.Errorf("Name [%s] err [%s] shutting down log logger \n", lf.info.ContainerName, err.Error())
-				if len(lf.tempStr) > 0 {
-					buf.Line = append([]byte(strings.Join(lf.tempStr, "\n\r")), buf.Line...)
-					sendMessage(lf.driver, buf, lf.info.ContainerID)
+	w := logger.NewLogWatcher()
+	go func() {
+		defer jsonl.Close()
+		defer close(w.Msg)
+		for {
+			select {
+			case m, ok := <-r.Msg:
+				if !ok {
+					return
 				}
-				lf.stream.Close()
+				w.Msg <- m
+			case err := <-r.Err:
+				w.Err <- err
 				return
 			}
-			dec = protoio.NewUint32DelimitedReader(lf.stream, binary.BigEndian, 1e6)
 		}
+	}()
+	return w, nil
+}
 
-		lf.jsonl.Log(&logger.Message{Line: buf.Line, Source: lf.info.ContainerName})
+// consumeLog 读取FIFO中的日志, FIFO结束或者无法继续读取时发送未完成的事件后退出.
+// 返回读取FIFO的错误, FIFO结束或者被StopLogging关闭时返回nil
+func consumeLog(lf *logPair) error {
+
+	defer close(lf.done)
+	buf := getLogEntry(lf.info.ContainerID)
 
-		if idx >= lf.bufLines {
-			buf.Line = append([]byte(strings.Join(lf.tempStr, "\n\r")), buf.Line...)
-			if sendMessage(lf.driver, buf, lf.info.ContainerID) == false {
-				continue
+	for {
+		if err := lf.dec.ReadMsg(buf); err != nil {
+			if err == io.EOF || lf.stopped() {
+				err = nil
+			} else {
+				logrus.WithField("container", lf.info.ContainerID).Errorf("cannot read log fifo, stop reading logs of %s: %v", lf.info.Name(), err)
 			}
-			lf.tempStr = lf.tempStr[:0]
-			idx = 0
-		} else {
-			lf.tempStr = append(lf.tempStr, string(buf.Line))
+			// 没有等到最后一个片段的partial日志作为完整的一行, 与其它日志一样写入jsonl
+			for _, p := range lf.partials {
+				lf.jsonl.Log(&logger.Message{Line: p.Line, Source: lf.info.ContainerName})
+				lf.groupLine(p)
+			}
+			lf.flushAll()
+			lf.stream.Close()
+			return err
+		}
+		atomic.AddUint64(&lf.frames, 1)
+
+		if !lf.reassemble(buf) {
+			buf.Reset()
+			continue
 		}
 
+		lf.jsonl.Log(&logger.Message{Line: buf.Line, Source: lf.info.ContainerName})
+
+		lf.groupLine(buf)
 		buf.Reset()
 	}
 }
 
-func sendMessage(l logger.Logger, buf *logdriver.LogEntry, containerid string) bool {
+// stopped StopLogging超时后主动关闭了FIFO
+func (lf *logPair) stopped() bool {
+	select {
+	case <-lf.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// reassemble 拼接Docker拆分的partial日志(超过16K的行会被拆分成多个Partial=true的片段).
+// 返回false表示buf只是一个片段, 需要等待后续的片段. 拼接后超过partialMax时提前结束, 作为单独的一行
+func (lf *logPair) reassemble(buf *logdriver.LogEntry) bool {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	p := lf.partials[buf.Source]
+	if p == nil {
+		if !buf.Partial {
+			return true
+		}
+		p = &logdriver.LogEntry{Source: buf.Source, TimeNano: buf.TimeNano}
+		lf.partials[buf.Source] = p
+	}
+
+	p.Line = append(p.Line, buf.Line...)
+	if buf.Partial && len(p.Line) < lf.partialMax {
+		return false
+	}
+
+	delete(lf.partials, buf.Source)
+	buf.TimeNano = p.TimeNano
+	buf.Line = p.Line
+	buf.Partial = false
+	return true
+}
+
+func sendMessage(l logger.Logger, buf *logdriver.LogEntry, attrs map[string]string, containerid string) bool {
 	var msg logger.Message
 	msg.Line = buf.Line
 	msg.Source = buf.Source
 	msg.Partial = buf.Partial
 	msg.Timestamp = time.Unix(0, buf.TimeNano)
+	msg.Attrs = attrs
 	err := l.Log(&msg)
 	if err != nil {
-		fmt.Errorf("id [%s] err [%s] error writing log message \n", containerid, err.Error())
+		// 重试之后失败的事件已经由deliveryLogger记录
+		if !isUndelivered(err) {
+			logrus.WithField("container", containerid).Errorf("error writing log message: %v", err)
+		}
 		return false
 	}
 	return true
@@ -169,11 +528,35 @@ func sendMessage(l logger.Logger, buf *logdriver.LogEntry, containerid string) b
 // New 返回特定类型的Logging Driver
 // 支持的驱动类型:
 // graylog - 目前仅支持udp协议
+// fluentd - fluentd forward协议, 支持tcp和unix socket
+// syslog - RFC 5424/RFC 3164, 支持udp, tcp, tcp+tls和unix socket
+// elasticsearch - 通过_bulk接口批量写入Elasticsearch/OpenSearch
+// loki - 通过push接口批量写入Grafana Loki
+// kafka - 通过Produce API写入Kafka, 支持gzip, snappy和lz4压缩
+// http - 通过HTTP批量发送NDJSON
+// splunk - 通过HTTP Event Collector写入Splunk
+// 设置drivers时同时发送给多个driver, 参见NewFanout
 func New(info logger.Info) (logger.Logger, error) {
+	if info.Config["drivers"] != "" {
+		return NewFanout(info)
+	}
 	switch strings.ToLower(strings.TrimSpace(info.Config["driver"])) {
 	case "graylog":
-		bufMap = make(map[string]logdriver.LogEntry)
 		return NewGelf(info)
+	case "fluentd":
+		return NewFluentd(info)
+	case "syslog":
+		return NewSyslog(info)
+	case "elasticsearch":
+		return NewElasticsearch(info)
+	case "loki":
+		return NewLoki(info)
+	case "kafka":
+		return NewKafka(info)
+	case "http":
+		return NewHTTP(info)
+	case "splunk":
+		return NewSplunk(info)
 	default:
 		return jsonfilelog.New(info)
 	}
@@ -188,3 +571,16 @@ func getLogEntry(id string) *logdriver.LogEntry {
 	}
 	return &buf
 }
+
+// parseDuration 解析时间类型的参数, 未设置时返回0
+func parseDuration(cfg map[string]string, key string) (time.Duration, error) {
+	v, ok := cfg[key]
+	if !ok || v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration like 500ms, got %q", key, v)
+	}
+	return d, nil
+}
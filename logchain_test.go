@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/andy-zhangtao/logchain/logging"
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
+	protoio "github.com/gogo/protobuf/io"
+)
+
+func newTestLogChain() *LogChain {
+	return &LogChain{
+		logs: make(map[string]*logPair),
+		idx:  make(map[string]*logPair),
+	}
+}
+
+// startContainer 像Docker一样创建FIFO并调用Handler, 返回FIFO的写入端
+func startContainer(t *testing.T, lc *LogChain, dir string, i int, cfg map[string]string) (logging.LogsRequest, *os.File) {
+	id := fmt.Sprintf("%064x", i+1)
+	lr := logging.LogsRequest{
+		File: filepath.Join(dir, id+".fifo"),
+		Info: logger.Info{
+			ContainerID:   id,
+			ContainerName: fmt.Sprintf("/c%d", i),
+			LogPath:       filepath.Join(dir, id, id+"-json.log"),
+			Config:        cfg,
+		},
+	}
+	if err := syscall.Mkfifo(lr.File, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// 两端都在对方打开之后才返回
+	opened := make(chan *os.File, 1)
+	go func() {
+		w, err := os.OpenFile(lr.File, os.O_WRONLY, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- w
+	}()
+	if err := lc.Handler(lr); err != nil {
+		t.Fatal(err)
+	}
+	return lr, <-opened
+}
+
+func writeEntries(t *testing.T, w *os.File, lines ...string) {
+	pw := protoio.NewUint32DelimitedWriter(w, binary.BigEndian)
+	for _, line := range lines {
+		if err := pw.WriteMsg(&logdriver.LogEntry{Source: "stdout", Line: []byte(line), TimeNano: time.Now().UnixNano()}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+// openFiles 返回当前进程打开的dir中的文件
+func openFiles(t *testing.T, dir string) []string {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("cannot list open files:", err)
+	}
+	var files []string
+	for _, fd := range fds {
+		if p, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); err == nil && strings.HasPrefix(p, dir) {
+			files = append(files, p)
+		}
+	}
+	return files
+}
+
+// TestStartStopConcurrent 并发启动和停止多个容器, 停止后FIFO, jsonl和driver都已关闭, LogChain中不再有容器
+func TestStartStopConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20
+	lc := newTestLogChain()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cfg := map[string]string{"buf": "2"}
+			if i%2 == 0 {
+				cfg["flush-interval"] = "10ms"
+			}
+			lr, w := startContainer(t, lc, dir, i, cfg)
+			writeEntries(t, w, "first", "second", "third")
+			// Docker在StopLogging之前关闭写入端
+			w.Close()
+			if err := lc.HandlerStop(lr); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	lc.mu.Lock()
+	if len(lc.logs) != 0 || len(lc.idx) != 0 {
+		t.Errorf("%d fifos and %d containers left after stopping", len(lc.logs), len(lc.idx))
+	}
+	lc.mu.Unlock()
+	if files := openFiles(t, dir); len(files) > 0 {
+		t.Errorf("files left open after stopping: %v", files)
+	}
+
+	// 每个容器的三行都写入了本地的jsonfile
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("%064x", i+1)
+		b, err := ioutil.ReadFile(filepath.Join(dir, id, id+"-json.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range []string{"first", "second", "third"} {
+			if !strings.Contains(string(b), line) {
+				t.Errorf("container %d: %q not in the local log", i, line)
+			}
+		}
+	}
+}
+
+// TestInterruptDrainsFifo interrupt先读完FIFO中的日志, 写入端关闭后不再等待timeout
+func TestInterruptDrainsFifo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lc := newTestLogChain()
+	lr, w := startContainer(t, lc, dir, 0, map[string]string{})
+	lc.mu.Lock()
+	lf := lc.logs[lr.File]
+	lc.mu.Unlock()
+
+	writeEntries(t, w, "before")
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		lf.interrupt(5 * time.Second)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	writeEntries(t, w, "after")
+	w.Close()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("interrupt did not return after the fifo was closed")
+	}
+	if lf.stopped() {
+		t.Errorf("fifo closed by interrupt after %v, want EOF", time.Since(start))
+	}
+	if err := lf.closeLoggers(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(lr.Info.LogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "before") || !strings.Contains(string(b), "after") {
+		t.Errorf("lines written before EOF are lost: %s", b)
+	}
+}
+
+// TestReadErrorTeardown 读取FIFO失败后容器像StopLogging一样被移除
+func TestReadErrorTeardown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lc := newTestLogChain()
+	lr, w := startContainer(t, lc, dir, 0, map[string]string{})
+	defer w.Close()
+	lc.mu.Lock()
+	lf := lc.logs[lr.File]
+	lc.mu.Unlock()
+
+	// 不经过StopLogging关闭FIFO, consumeLog读取失败
+	lf.stream.Close()
+	<-lf.done
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lc.mu.Lock()
+		n, m := len(lc.logs), len(lc.idx)
+		lc.mu.Unlock()
+		if n == 0 && m == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d fifos and %d containers left after a read error", n, m)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lc.wg.Wait()
+	if err := lc.HandlerStop(lr); err == nil {
+		t.Error("StopLogging found a container which was torn down")
+	}
+}
+
+// TestReassemble 按stream拼接partial片段, 使用第一个片段的时间; 超过partialMax时提前结束, 剩余片段作为新的一行
+func TestReassemble(t *testing.T) {
+	lf := newTestPair(&captureLogger{}, 1)
+	lf.partials = make(map[string]*logdriver.LogEntry)
+	lf.partialMax = 1 << 20
+
+	var got []string
+	feed := func(source, line string, partial bool, ts int64) {
+		buf := &logdriver.LogEntry{Source: source, Line: []byte(line), Partial: partial, TimeNano: ts}
+		if lf.reassemble(buf) {
+			if buf.Partial {
+				t.Errorf("reassembled line %q is still partial", buf.Line)
+			}
+			got = append(got, fmt.Sprintf("%s:%s@%d", buf.Source, buf.Line, buf.TimeNano))
+		}
+	}
+	feed("stdout", "ab", true, 1)
+	feed("stderr", "err", true, 2)
+	feed("stdout", "cd", true, 3)
+	feed("stdout", "ef", false, 4)
+	feed("stdout", "whole", false, 5)
+	feed("stderr", "or", false, 6)
+	if want := "stdout:abcdef@1 stdout:whole@5 stderr:error@2"; strings.Join(got, " ") != want {
+		t.Errorf("got %q, want %q", strings.Join(got, " "), want)
+	}
+
+	got = nil
+	lf.partialMax = 4
+	feed("stdout", "abc", true, 1)
+	feed("stdout", "def", true, 2)
+	feed("stdout", "gh", false, 3)
+	if want := "stdout:abcdef@1 stdout:gh@3"; strings.Join(got, " ") != want {
+		t.Errorf("partial-max-size: got %q, want %q", strings.Join(got, " "), want)
+	}
+	if len(lf.partials) != 0 {
+		t.Errorf("fragments left: %v", lf.partials)
+	}
+}
+
+// TestPartialAtEOF FIFO结束时没有最后一个片段的partial日志写入jsonl并发送给driver
+func TestPartialAtEOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bodies := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(b)
+	}))
+	defer srv.Close()
+
+	lc := newTestLogChain()
+	lr, w := startContainer(t, lc, dir, 0, map[string]string{"driver": "http", "http-url": srv.URL, "http-format": "raw"})
+	pw := protoio.NewUint32DelimitedWriter(w, binary.BigEndian)
+	for _, e := range []*logdriver.LogEntry{
+		{Source: "stdout", Line: []byte("complete"), TimeNano: time.Now().UnixNano()},
+		{Source: "stdout", Line: []byte("first half "), Partial: true, TimeNano: time.Now().UnixNano()},
+		{Source: "stdout", Line: []byte("second half"), Partial: true, TimeNano: time.Now().UnixNano()},
+	} {
+		if err := pw.WriteMsg(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	if err := lc.HandlerStop(lr); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(lr.Info.LogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"complete", "first half second half"} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("jsonl is missing %q: %s", line, b)
+		}
+	}
+	close(bodies)
+	var sent bytes.Buffer
+	for body := range bodies {
+		sent.WriteString(body)
+	}
+	if sent.String() != "complete\nfirst half second half\n" {
+		t.Errorf("driver got %q", sent.String())
+	}
+}
@@ -207,5 +207,7 @@ func parseParaViaEnv(lr *LogsRequest) {
 
 		lr.Info.Config[strings.TrimSpace(lgk[0])] = strings.TrimSpace(lgk[1])
 	}
-	lr.Info.Config["driver"] = "graylog"
+	if _, ok := lr.Info.Config["driver"]; !ok {
+		lr.Info.Config["driver"] = "graylog"
+	}
 }
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	lokiName          = "loki"
+	lokiPushPath      = "/loki/api/v1/push"
+	defaultLokiBatch  = 1000
+	defaultLokiBytes  = 1 << 20
+	defaultLokiLabels = 15
+	defaultLokiRetry  = 3
+	lokiRetryInterval = 500 * time.Millisecond
+)
+
+var (
+	lokiLabelName   = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	lokiInvalidChar = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+	// lokiHighCardinality 每个容器或者每条日志都不同的标签, 会导致Loki中的stream数量暴涨
+	lokiHighCardinality = map[string]bool{
+		"container_id": true,
+		"image_id":     true,
+		"id":           true,
+		"created":      true,
+		"command":      true,
+		"request_id":   true,
+		"trace_id":     true,
+	}
+)
+
+// lokiLogger 通过/loki/api/v1/push批量发送日志, 支持protobuf+snappy和json两种编码.
+// 同一批中的日志按照标签分成多个stream, 每个stream中的日志保持到达的顺序
+type lokiLogger struct {
+	client   *http.Client
+	url      string
+	json     bool
+	tenant   string
+	username string
+	password string
+	labels   map[string]string
+	retry    *retryPolicy
+	batch    *batcher
+}
+
+// NewLoki creates a loki logger. The supported log opts are loki-url, loki-encoding,
+// loki-labels, loki-max-labels, loki-allow-high-cardinality, loki-tenant-id, loki-username,
+// loki-password, loki-batch-size, loki-batch-bytes, loki-flush-interval, loki-max-retries
+// and the http client options.
+func NewLoki(info logger.Info) (logger.Logger, error) {
+	cfg := info.Config
+
+	if cfg["loki-url"] == "" {
+		return nil, fmt.Errorf("loki: loki-url is a required parameter")
+	}
+	u := strings.TrimRight(cfg["loki-url"], "/")
+	if !strings.HasSuffix(u, lokiPushPath) {
+		u += lokiPushPath
+	}
+
+	l := &lokiLogger{
+		url:      u,
+		tenant:   cfg["loki-tenant-id"],
+		username: cfg["loki-username"],
+		password: cfg["loki-password"],
+	}
+
+	switch cfg["loki-encoding"] {
+	case "", "protobuf":
+	case "json":
+		l.json = true
+	default:
+		return nil, fmt.Errorf("loki: unknown loki-encoding %q, must be protobuf or json", cfg["loki-encoding"])
+	}
+
+	var err error
+	if l.labels, err = lokiLabels(info); err != nil {
+		return nil, err
+	}
+
+	if l.client, err = newHTTPClient(cfg, lokiName); err != nil {
+		return nil, fmt.Errorf("loki: %v", err)
+	}
+
+	if l.retry, err = newRetryPolicy(cfg, lokiName, defaultLokiRetry, lokiRetryInterval); err != nil {
+		return nil, fmt.Errorf("loki: %v", err)
+	}
+
+	size, err := parseInt(cfg, "loki-batch-size", defaultLokiBatch)
+	if err != nil {
+		return nil, fmt.Errorf("loki: %v", err)
+	}
+	maxBytes, err := parseInt(cfg, "loki-batch-bytes", defaultLokiBytes)
+	if err != nil {
+		return nil, fmt.Errorf("loki: %v", err)
+	}
+	interval, err := parseDuration(cfg, "loki-flush-interval")
+	if err != nil {
+		return nil, err
+	}
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	l.batch = newBatcher(lokiName, size, interval, l.send)
+	l.batch.maxBytes = maxBytes
+	return l, nil
+}
+
+// lokiLabels 生成容器的stream标签: 容器名, 镜像, compose的project和service, 通过labels/env选择的容器属性,
+// 以及loki-labels中指定的k=v. 高基数的标签默认会被拒绝
+func lokiLabels(info logger.Info) (map[string]string, error) {
+	cfg := info.Config
+
+	extra, err := containerExtra(info, "")
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{
+		"container_name": fmt.Sprint(extra["container_name"]),
+		"image":          fmt.Sprint(extra["image_name"]),
+	}
+	if v := info.ContainerLabels["com.docker.compose.project"]; v != "" {
+		labels["compose_project"] = v
+	}
+	if v := info.ContainerLabels["com.docker.compose.service"]; v != "" {
+		labels["compose_service"] = v
+	}
+
+	attrs, err := info.ExtraAttributes(nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range attrs {
+		labels[lokiInvalidChar.ReplaceAllString(k, "_")] = v
+	}
+
+	if v := cfg["loki-labels"]; v != "" {
+		for _, kv := range strings.Split(v, ",") {
+			p := strings.SplitN(kv, "=", 2)
+			if len(p) != 2 {
+				return nil, fmt.Errorf("loki: loki-labels must be in form k=v,k2=v2, got %q", kv)
+			}
+			labels[strings.TrimSpace(p[0])] = strings.TrimSpace(p[1])
+		}
+	}
+
+	allowHigh := false
+	if v, ok := cfg["loki-allow-high-cardinality"]; ok {
+		if allowHigh, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("loki: loki-allow-high-cardinality must be true or false")
+		}
+	}
+
+	maxLabels, err := parseInt(cfg, "loki-max-labels", defaultLokiLabels)
+	if err != nil {
+		return nil, fmt.Errorf("loki: %v", err)
+	}
+
+	for k, v := range labels {
+		if v == "" {
+			delete(labels, k)
+			continue
+		}
+		if !lokiLabelName.MatchString(k) {
+			return nil, fmt.Errorf("loki: invalid label name %q", k)
+		}
+		if lokiHighCardinality[k] && !allowHigh {
+			return nil, fmt.Errorf("loki: label %q has high cardinality, set loki-allow-high-cardinality=true to use it", k)
+		}
+	}
+	// source标签在发送时按照stdout/stderr添加
+	if len(labels)+1 > maxLabels {
+		return nil, fmt.Errorf("loki: %d labels exceed loki-max-labels %d", len(labels)+1, maxLabels)
+	}
+
+	return labels, nil
+}
+
+func (l *lokiLogger) Log(msg *logger.Message) error {
+	err := l.batch.Add(msg)
+	logger.PutMessage(msg)
+	return err
+}
+
+// lokiStream 一个stream中的日志
+type lokiStream struct {
+	labels  map[string]string
+	entries []*logger.Message
+}
+
+// send 按照source分成不同的stream后发送, 429和5xx按照重试策略重试, 其它错误不再重试
+func (l *lokiLogger) send(msgs []*logger.Message) error {
+	var streams []*lokiStream
+	idx := make(map[string]*lokiStream)
+	for _, m := range msgs {
+		s := idx[m.Source]
+		if s == nil {
+			s = &lokiStream{labels: make(map[string]string, len(l.labels)+1)}
+			for k, v := range l.labels {
+				s.labels[k] = v
+			}
+			if m.Source != "" {
+				s.labels["source"] = m.Source
+			}
+			idx[m.Source] = s
+			streams = append(streams, s)
+		}
+		s.entries = append(s.entries, m)
+	}
+
+	var body []byte
+	var err error
+	if l.json {
+		body, err = encodeLokiJSON(streams)
+	} else {
+		body = encodeSnappy(encodeLokiProto(streams))
+	}
+	if err != nil {
+		return permanent(fmt.Errorf("loki: %v", err))
+	}
+
+	return l.retry.do(lokiName, func() error {
+		retry, err := l.push(body)
+		if err != nil && !retry {
+			return permanent(err)
+		}
+		return err
+	})
+}
+
+// push 发送一次请求, 返回的bool表示错误是否可以重试
+func (l *lokiLogger) push(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", l.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if l.json {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	}
+	if l.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", l.tenant)
+	}
+	if l.username != "" {
+		req.SetBasicAuth(l.username, l.password)
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("push failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+}
+
+// lokiLabelString 生成{k="v", ...}格式的标签, 按名称排序
+func lokiLabelString(labels map[string]string) string {
+	keys := sortedKeys(labels)
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[k]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func encodeLokiJSON(streams []*lokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	req := struct {
+		Streams []jsonStream `json:"streams"`
+	}{}
+	for _, s := range streams {
+		js := jsonStream{Stream: s.labels}
+		for _, m := range s.entries {
+			js.Values = append(js.Values, [2]string{strconv.FormatInt(m.Timestamp.UnixNano(), 10), string(m.Line)})
+		}
+		req.Streams = append(req.Streams, js)
+	}
+	return json.Marshal(&req)
+}
+
+// encodeLokiProto 按照logproto.PushRequest编码:
+// PushRequest{streams=1}, Stream{labels=1, entries=2}, Entry{timestamp=1, line=2}, Timestamp{seconds=1, nanos=2}
+func encodeLokiProto(streams []*lokiStream) []byte {
+	var req []byte
+	for _, s := range streams {
+		stream := appendProtoBytes(nil, 1, []byte(lokiLabelString(s.labels)))
+		for _, m := range s.entries {
+			var ts []byte
+			ts = appendProtoVarint(ts, 1, uint64(m.Timestamp.Unix()))
+			ts = appendProtoVarint(ts, 2, uint64(m.Timestamp.Nanosecond()))
+			entry := appendProtoBytes(nil, 1, ts)
+			entry = appendProtoBytes(entry, 2, m.Line)
+			stream = appendProtoBytes(stream, 2, entry)
+		}
+		req = appendProtoBytes(req, 1, stream)
+	}
+	return req
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendUvarint(b, uint64(field)<<3)
+	return appendUvarint(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, p []byte) []byte {
+	b = appendUvarint(b, uint64(field)<<3|2)
+	b = appendUvarint(b, uint64(len(p)))
+	return append(b, p...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var p [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(p[:], v)
+	return append(b, p[:n]...)
+}
+
+func (l *lokiLogger) Close() error {
+	return l.batch.Close()
+}
+
+func (l *lokiLogger) batches() *batcher {
+	return l.batch
+}
+
+func (l *lokiLogger) Name() string {
+	return lokiName
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/gogo/protobuf/proto"
+)
+
+// protoFields 解码一个protobuf消息, 返回每个字段的值, varint字段的值为uint64, bytes字段为[]byte
+func protoFields(b []byte) (map[uint64][]interface{}, error) {
+	fields := make(map[uint64][]interface{})
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid field key")
+		}
+		b = b[n:]
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid varint")
+		}
+		b = b[n:]
+		switch key & 7 {
+		case proto.WireVarint:
+			fields[key>>3] = append(fields[key>>3], v)
+		case proto.WireBytes:
+			if uint64(len(b)) < v {
+				return nil, fmt.Errorf("truncated field %d", key>>3)
+			}
+			fields[key>>3] = append(fields[key>>3], b[:v])
+			b = b[v:]
+		default:
+			return nil, fmt.Errorf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields, nil
+}
+
+// lokiEntry 解码后的一个日志
+type lokiEntry struct {
+	ts   time.Time
+	line string
+}
+
+// decodeLokiPush 解码snappy压缩的logproto.PushRequest, 返回每个stream的标签和日志
+func decodeLokiPush(body []byte) (map[string][]lokiEntry, error) {
+	raw, err := decodeSnappy(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := protoFields(raw)
+	if err != nil {
+		return nil, err
+	}
+	streams := make(map[string][]lokiEntry)
+	for _, s := range req[1] {
+		stream, err := protoFields(s.([]byte))
+		if err != nil {
+			return nil, err
+		}
+		labels := string(stream[1][0].([]byte))
+		for _, e := range stream[2] {
+			entry, err := protoFields(e.([]byte))
+			if err != nil {
+				return nil, err
+			}
+			ts, err := protoFields(entry[1][0].([]byte))
+			if err != nil {
+				return nil, err
+			}
+			var sec, nsec uint64
+			if len(ts[1]) > 0 {
+				sec = ts[1][0].(uint64)
+			}
+			if len(ts[2]) > 0 {
+				nsec = ts[2][0].(uint64)
+			}
+			streams[labels] = append(streams[labels], lokiEntry{time.Unix(int64(sec), int64(nsec)).UTC(), string(entry[2][0].([]byte))})
+		}
+	}
+	return streams, nil
+}
+
+// TestLokiPush protobuf+snappy的请求可以被解码, 按照source分成stream并保持顺序, 带有租户和认证
+func TestLokiPush(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if r.URL.Path != lokiPushPath || r.Header.Get("Content-Type") != "application/x-protobuf" ||
+			r.Header.Get("X-Scope-OrgID") != "team-a" || user != "loki" || pass != "secret" {
+			t.Errorf("unexpected request %s %v", r.URL.Path, r.Header)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- b
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	l, err := NewLoki(logger.Info{
+		ContainerID:        "0123456789abcdef0123456789abcdef",
+		ContainerName:      "/web",
+		ContainerImageName: "nginx",
+		Config: map[string]string{
+			"loki-url":       srv.URL,
+			"loki-labels":    "env=prod",
+			"loki-tenant-id": "team-a",
+			"loki-username":  "loki",
+			"loki-password":  "secret",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lk := l.(*lokiLogger)
+	defer lk.Close()
+
+	base := time.Date(2024, 3, 5, 10, 0, 0, 123456789, time.UTC)
+	var msgs []*logger.Message
+	for i, m := range []struct{ source, line string }{{"stdout", "first"}, {"stderr", "oops"}, {"stdout", "second"}, {"stdout", "第三"}} {
+		msgs = append(msgs, &logger.Message{Source: m.source, Line: []byte(m.line), Timestamp: base.Add(time.Duration(i) * time.Second)})
+	}
+	if err := lk.send(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	streams, err := decodeLokiPush(<-bodies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]lokiEntry{
+		`{container_name="web", env="prod", image="nginx", source="stdout"}`: {
+			{base, "first"}, {base.Add(2 * time.Second), "second"}, {base.Add(3 * time.Second), "第三"},
+		},
+		`{container_name="web", env="prod", image="nginx", source="stderr"}`: {
+			{base.Add(time.Second), "oops"},
+		},
+	}
+	if fmt.Sprint(streams) != fmt.Sprint(want) {
+		t.Errorf("got streams %v, want %v", streams, want)
+	}
+}
+
+func TestLokiJSON(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- b
+	}))
+	defer srv.Close()
+
+	l, err := NewLoki(logger.Info{ContainerID: "0123456789abcdef0123456789abcdef", ContainerName: "/web", Config: map[string]string{"loki-url": srv.URL, "loki-encoding": "json"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lk := l.(*lokiLogger)
+	defer lk.Close()
+
+	ts := time.Unix(1700000000, 5)
+	if err := lk.send([]*logger.Message{{Source: "stdout", Line: []byte("hello"), Timestamp: ts}}); err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(<-bodies, &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Streams) != 1 || req.Streams[0].Stream["source"] != "stdout" || req.Streams[0].Values[0] != [2]string{"1700000000000000005", "hello"} {
+		t.Errorf("unexpected request %+v", req)
+	}
+}
+
+// TestLokiLabelGuard 高基数的标签和超过loki-max-labels的标签会使容器无法启动, loki-allow-high-cardinality允许高基数的标签
+func TestLokiLabelGuard(t *testing.T) {
+	info := func(cfg map[string]string) logger.Info {
+		cfg["loki-url"] = "http://loki:3100"
+		return logger.Info{
+			ContainerID:        "0123456789abcdef0123456789abcdef",
+			ContainerName:      "/web",
+			ContainerImageName: "nginx",
+			ContainerLabels:    map[string]string{"com.docker.compose.project": "shop", "com.docker.compose.service": "api"},
+			Config:             cfg,
+		}
+	}
+	for _, c := range []struct {
+		cfg  map[string]string
+		want string
+	}{
+		{map[string]string{"loki-labels": "trace_id=x"}, "high cardinality"},
+		{map[string]string{"loki-labels": "trace_id=x", "loki-allow-high-cardinality": "true"}, ""},
+		{map[string]string{"loki-labels": "a=1,b=2", "loki-max-labels": "6"}, "exceed loki-max-labels"},
+		{map[string]string{"loki-labels": "a=1", "loki-max-labels": "6"}, ""},
+		{map[string]string{"loki-labels": "bad-name=1"}, "invalid label name"},
+	} {
+		labels, err := lokiLabels(info(c.cfg))
+		if c.want == "" {
+			if err != nil {
+				t.Errorf("%v: %v", c.cfg, err)
+			} else if labels["compose_project"] != "shop" || labels["compose_service"] != "api" {
+				t.Errorf("%v: got labels %v", c.cfg, labels)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v: got error %v, want %q", c.cfg, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	lz4Magic     = 0x184D2204
+	lz4BlockSize = 64 << 10
+	lz4MinMatch  = 4
+	// lz4的block最后5个字节必须是literal, 最后一个match必须在结束前12个字节开始
+	lz4LastLiterals = 5
+	lz4MFLimit      = 12
+)
+
+// encodeLZ4Frame 按照LZ4 frame格式压缩src, Kafka的lz4压缩使用这种格式.
+// 块大小64K, 块之间独立, 不带checksum. 无法压缩的块按原样存储
+func encodeLZ4Frame(src []byte) []byte {
+	dst := make([]byte, 0, len(src)+len(src)/255+32)
+	dst = appendUint32LE(dst, lz4Magic)
+
+	// FLG: version 01, block independence; BD: 64KB max block size
+	desc := []byte{0x60, 0x40}
+	dst = append(dst, desc...)
+	dst = append(dst, byte(xxh32Small(desc, 0)>>8))
+
+	for len(src) > 0 {
+		block := src
+		if len(block) > lz4BlockSize {
+			block = block[:lz4BlockSize]
+		}
+		src = src[len(block):]
+
+		compressed := encodeLZ4Block(nil, block)
+		if len(compressed) >= len(block) {
+			dst = appendUint32LE(dst, uint32(len(block))|0x80000000)
+			dst = append(dst, block...)
+			continue
+		}
+		dst = appendUint32LE(dst, uint32(len(compressed)))
+		dst = append(dst, compressed...)
+	}
+
+	// EndMark
+	return appendUint32LE(dst, 0)
+}
+
+func encodeLZ4Block(dst, src []byte) []byte {
+	if len(src) < lz4MFLimit+1 {
+		return appendLZ4Sequence(dst, src, 0, 0)
+	}
+
+	var table [1 << 14]int32
+	hash := func(u uint32) uint32 { return (u * 2654435761) >> (32 - 14) }
+
+	anchor := 0
+	limit := len(src) - lz4MFLimit
+	for i := 0; i < limit; {
+		u := binary.LittleEndian.Uint32(src[i:])
+		h := hash(u)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if cand < 0 || i-cand > 0xffff || binary.LittleEndian.Uint32(src[cand:]) != u {
+			i++
+			continue
+		}
+
+		n := lz4MinMatch
+		for i+n < len(src)-lz4LastLiterals && src[cand+n] == src[i+n] {
+			n++
+		}
+
+		dst = appendLZ4Sequence(dst, src[anchor:i], i-cand, n)
+		i += n
+		anchor = i
+	}
+	return appendLZ4Sequence(dst, src[anchor:], 0, 0)
+}
+
+// appendLZ4Sequence 写入一个sequence, matchLen为0时表示block最后只有literal的sequence
+func appendLZ4Sequence(dst, lit []byte, offset, matchLen int) []byte {
+	litLen := len(lit)
+	token := byte(0)
+	if litLen >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(litLen) << 4
+	}
+	ml := matchLen - lz4MinMatch
+	if matchLen > 0 {
+		if ml >= 15 {
+			token |= 15
+		} else {
+			token |= byte(ml)
+		}
+	}
+
+	dst = append(dst, token)
+	if litLen >= 15 {
+		dst = appendLZ4Len(dst, litLen-15)
+	}
+	dst = append(dst, lit...)
+
+	if matchLen == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if ml >= 15 {
+		dst = appendLZ4Len(dst, ml-15)
+	}
+	return dst
+}
+
+func appendLZ4Len(dst []byte, n int) []byte {
+	for n >= 255 {
+		dst = append(dst, 255)
+		n -= 255
+	}
+	return append(dst, byte(n))
+}
+
+func appendUint32LE(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+const (
+	xxhPrime1 uint32 = 2654435761
+	xxhPrime2 uint32 = 2246822519
+	xxhPrime3 uint32 = 3266489917
+	xxhPrime4 uint32 = 668265263
+	xxhPrime5 uint32 = 374761393
+)
+
+// xxh32Small 计算长度小于16字节的数据的xxHash32, 用于lz4 frame的header checksum
+func xxh32Small(p []byte, seed uint32) uint32 {
+	h := seed + xxhPrime5 + uint32(len(p))
+	for ; len(p) >= 4; p = p[4:] {
+		h += binary.LittleEndian.Uint32(p) * xxhPrime3
+		h = bits.RotateLeft32(h, 17) * xxhPrime4
+	}
+	for _, c := range p {
+		h += uint32(c) * xxhPrime5
+		h = bits.RotateLeft32(h, 11) * xxhPrime1
+	}
+	h ^= h >> 15
+	h *= xxhPrime2
+	h ^= h >> 13
+	h *= xxhPrime3
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// decodeLZ4Frame 按照LZ4 frame格式解压, 与encodeLZ4Frame独立实现, 检查header checksum
+func decodeLZ4Frame(src []byte) ([]byte, error) {
+	if len(src) < 7 || binary.LittleEndian.Uint32(src) != lz4Magic {
+		return nil, fmt.Errorf("invalid magic")
+	}
+	flg := src[4]
+	if flg>>6 != 1 {
+		return nil, fmt.Errorf("unsupported version %d", flg>>6)
+	}
+	descLen := 2
+	if flg&0x08 != 0 {
+		descLen += 8 // content size
+	}
+	if len(src) < 4+descLen+1 {
+		return nil, fmt.Errorf("truncated header")
+	}
+	desc := src[4 : 4+descLen]
+	if hc := byte(xxh32Small(desc, 0) >> 8); src[4+descLen] != hc {
+		return nil, fmt.Errorf("header checksum %#x, want %#x", src[4+descLen], hc)
+	}
+	src = src[4+descLen+1:]
+
+	var dst []byte
+	for {
+		if len(src) < 4 {
+			return nil, fmt.Errorf("truncated block size")
+		}
+		size := binary.LittleEndian.Uint32(src)
+		src = src[4:]
+		if size == 0 {
+			break
+		}
+		n := int(size &^ 0x80000000)
+		if len(src) < n {
+			return nil, fmt.Errorf("truncated block")
+		}
+		if size&0x80000000 != 0 {
+			dst = append(dst, src[:n]...)
+		} else {
+			var err error
+			if dst, err = decodeLZ4Block(dst, src[:n]); err != nil {
+				return nil, err
+			}
+		}
+		src = src[n:]
+		if flg&0x10 != 0 {
+			src = src[4:] // block checksum
+		}
+	}
+	if len(src) != 0 {
+		return nil, fmt.Errorf("%d bytes after the end mark", len(src))
+	}
+	return dst, nil
+}
+
+// decodeLZ4Block 解压一个LZ4 block并追加到dst, 块之间独立
+func decodeLZ4Block(dst, src []byte) ([]byte, error) {
+	start := len(dst)
+	readLen := func(n int) (int, error) {
+		if n < 15 {
+			return n, nil
+		}
+		for {
+			if len(src) == 0 {
+				return 0, fmt.Errorf("truncated length")
+			}
+			b := src[0]
+			src = src[1:]
+			n += int(b)
+			if b != 255 {
+				return n, nil
+			}
+		}
+	}
+	for len(src) > 0 {
+		token := src[0]
+		src = src[1:]
+		litLen, err := readLen(int(token >> 4))
+		if err != nil {
+			return nil, err
+		}
+		if len(src) < litLen {
+			return nil, fmt.Errorf("truncated literal")
+		}
+		dst = append(dst, src[:litLen]...)
+		src = src[litLen:]
+		if len(src) == 0 {
+			return dst, nil
+		}
+		if len(src) < 2 {
+			return nil, fmt.Errorf("truncated offset")
+		}
+		offset := int(binary.LittleEndian.Uint16(src))
+		src = src[2:]
+		matchLen, err := readLen(int(token & 15))
+		if err != nil {
+			return nil, err
+		}
+		matchLen += lz4MinMatch
+		if offset == 0 || offset > len(dst)-start {
+			return nil, fmt.Errorf("invalid offset %d", offset)
+		}
+		for i := 0; i < matchLen; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	return dst, nil
+}
+
+func TestXXH32(t *testing.T) {
+	for in, want := range map[string]uint32{
+		"":    0x02cc5d05,
+		"a":   0x550d7456,
+		"abc": 0x32d153ff,
+	} {
+		if got := xxh32Small([]byte(in), 0); got != want {
+			t.Errorf("xxh32(%q) = %#x, want %#x", in, got, want)
+		}
+	}
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	for name, in := range compressionInputs() {
+		got, err := decodeLZ4Frame(encodeLZ4Frame(in))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, in) {
+			t.Errorf("%s: round trip mismatch", name)
+		}
+	}
+	in := compressionInputs()["repeated"]
+	if n := len(encodeLZ4Frame(in)); n > len(in)/10 {
+		t.Errorf("repeated data compressed to %d of %d bytes", n, len(in))
+	}
+}
@@ -19,6 +19,14 @@ var logLevels = map[string]logrus.Level{
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "redeliver" {
+		if err := redeliver(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logrus.Println("==LogChain 1.0.5==")
 	levelVal := os.Getenv("LOG_LEVEL")
 	if levelVal == "" {
@@ -30,13 +38,47 @@ func main() {
 		fmt.Fprintln(os.Stderr, "invalid log level: ", levelVal)
 		os.Exit(1)
 	}
+	timeout, err := shutdownTimeout()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	metricsAddr, metricsMax, err := metricsConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	adminAddr, err := adminAddress()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var conf *pluginConfig
+	confPath := configFile()
+	if confPath != "" {
+		if conf, err = loadConfig(confPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 	u, _ := user.Lookup("root")
 	gid, _ := strconv.Atoi(u.Gid)
 
 	lc := LogChain{
 		logs: make(map[string]*logPair),
 		idx:  make(map[string]*logPair),
-		stop: make(chan int),
+		conf: conf,
+	}
+
+	go handleSignals(&lc, timeout)
+	if confPath != "" {
+		go lc.watchConfig(confPath)
+	}
+	if metricsAddr != "" {
+		go serveMetrics(&lc, metricsAddr, metricsMax)
+	}
+	if adminAddr != "" {
+		go serveAdmin(&lc, adminAddr)
 	}
 
 	h := logging.NewHandler(&lc)
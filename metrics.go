@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// defaultMetricsMaxContainers 默认单独标记的容器数, 超过后的容器合并到container_id="other"
+const defaultMetricsMaxContainers = 100
+
+// otherContainer 超过容器数限制后使用的标签
+const otherContainer = "other"
+
+// latencyBuckets 发送耗时直方图的上限(秒), 与Prometheus客户端的默认值相同
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram 一个Prometheus直方图, counts[i]为不超过latencyBuckets[i]的次数(不累加)
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+var (
+	latencyMu sync.Mutex
+	latencies = make(map[string]*histogram) /*按driver统计的发送耗时*/
+)
+
+// observeDelivery 记录driver一次发送(包括重试)的耗时
+func observeDelivery(driver string, d time.Duration) {
+	v := d.Seconds()
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+	h := latencies[driver]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		latencies[driver] = h
+	}
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metricsConfig 解析环境变量METRICS_ADDRESS和METRICS_MAX_CONTAINERS, 地址为空时不开启metrics
+func metricsConfig() (string, int, error) {
+	addr := os.Getenv("METRICS_ADDRESS")
+	max := defaultMetricsMaxContainers
+	if v := os.Getenv("METRICS_MAX_CONTAINERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return "", 0, fmt.Errorf("METRICS_MAX_CONTAINERS must be a non-negative integer, got %q", v)
+		}
+		max = n
+	}
+	return addr, max, nil
+}
+
+// metrics 将LogChain的统计输出为Prometheus文本格式. 容器按照出现的顺序获得自己的标签,
+// 最多max个, 容器停止后释放; 其它容器的统计合并到container_name="other"和container_id="other".
+// 合并到other的容器在停止之前一直使用other, 停止后它的计数保留在otherBase中, other的counter只会增加
+type metrics struct {
+	lc  *LogChain
+	max int
+
+	mu        sync.Mutex
+	labeled   map[string]bool       /*拥有自己标签的容器*/
+	other     map[string]*metricSet /*合并到other的容器以及它们上一次的counter*/
+	otherBase metricSet             /*已经停止的other容器的counter*/
+}
+
+func newMetrics(lc *LogChain, max int) *metrics {
+	return &metrics{lc: lc, max: max, labeled: make(map[string]bool), other: make(map[string]*metricSet)}
+}
+
+// serveMetrics 在addr上提供/metrics, 插件使用host网络, 地址应该只监听本机或者内部网络
+func serveMetrics(lc *LogChain, addr string, max int) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", newMetrics(lc, max))
+	logrus.Infof("serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logrus.Errorf("metrics: %v", err)
+	}
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.render())
+}
+
+// otherLabels 合并到other的容器使用的标签
+var otherLabels = fmt.Sprintf(`container_name="%s",container_id="%s"`, otherContainer, otherContainer)
+
+// labels 返回容器的标签, 并更新拥有自己标签和合并到other的容器. 停止的other容器上一次的counter加入otherBase.
+// 调用者需要持有m.mu
+func (m *metrics) labels(stats []ContainerStats) []string {
+	running := make(map[string]bool, len(stats))
+	for _, s := range stats {
+		running[s.ContainerID] = true
+	}
+	for id := range m.labeled {
+		if !running[id] {
+			delete(m.labeled, id)
+		}
+	}
+	for id, last := range m.other {
+		if !running[id] {
+			m.otherBase.merge(last)
+			delete(m.other, id)
+		}
+	}
+
+	labels := make([]string, len(stats))
+	for i, s := range stats {
+		id := s.ContainerID
+		if !m.labeled[id] && m.other[id] == nil {
+			if len(m.labeled) < m.max {
+				m.labeled[id] = true
+			} else {
+				m.other[id] = &metricSet{}
+			}
+		}
+		if m.labeled[id] {
+			labels[i] = fmt.Sprintf(`container_name="%s",container_id="%s"`, escapeLabel(s.ContainerName), escapeLabel(id))
+		} else {
+			labels[i] = otherLabels
+		}
+	}
+	return labels
+}
+
+func (m *metrics) render() []byte {
+	stats := m.lc.Stats()
+	// 按照容器ID排序, 每次输出的顺序相同
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ContainerID < stats[j].ContainerID })
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	labels := m.labels(stats)
+
+	var set metricSet
+	set.add("logchain_containers", "gauge", "Containers currently logging through the plugin.", "", float64(len(stats)))
+	for i, s := range stats {
+		var cs metricSet
+		addContainerMetrics(&cs, s, labels[i])
+		if last := m.other[s.ContainerID]; last != nil {
+			*last = cs.counters()
+		}
+		set.merge(&cs)
+	}
+	set.merge(&m.otherBase)
+
+	var b bytes.Buffer
+	set.write(&b)
+	writeLatencies(&b)
+	return b.Bytes()
+}
+
+// addContainerMetrics 将容器的统计加入set, c为容器的标签
+func addContainerMetrics(set *metricSet, s ContainerStats, c string) {
+	set.add("logchain_frames_read_total", "counter", "Log entries read from the container FIFO.", c, float64(s.Frames))
+	set.add("logchain_lines_grouped_total", "counter", "Lines added to a pending event.", c, float64(s.Lines))
+	set.add("logchain_pending_lines", "gauge", "Lines waiting in tempStr to be grouped into an event.", c, float64(s.Pending))
+	set.add("logchain_events_sent_total", "counter", "Events passed to the driver.", c, float64(s.Sent))
+	set.add("logchain_send_errors_total", "counter", "Events the driver returned an error for.", c, float64(s.SendErrors))
+	set.add("logchain_decode_errors_total", "counter", "Log entries that could not be decoded.", c, float64(s.Decode.Errors))
+	set.add("logchain_truncated_frames_total", "counter", "Log entries truncated because they exceed the maximum frame size.", c, float64(s.Decode.Truncated))
+	set.add("logchain_skipped_bytes_total", "counter", "Bytes skipped while looking for the next log entry.", c, float64(s.Decode.SkippedBytes))
+
+	var bufferFull, rateLimited uint64
+	if s.Buffer != nil {
+		bufferFull = s.Buffer.Dropped
+		set.add("logchain_buffered_events", "gauge", "Events waiting in the non-blocking buffer.", c, float64(s.Buffer.Buffered))
+	}
+	if s.RateLimit != nil {
+		rateLimited = s.RateLimit.Suppressed
+	}
+	set.add(droppedMetric, "counter", droppedHelp, c+`,reason="buffer_full"`, float64(bufferFull))
+	set.add(droppedMetric, "counter", droppedHelp, c+`,reason="rate_limit"`, float64(rateLimited))
+	set.add(droppedMetric, "counter", droppedHelp, c+`,reason="paused"`, float64(s.PauseDropped))
+
+	for _, d := range s.Destinations {
+		dl := fmt.Sprintf(`%s,destination="%s",driver="%s"`, c, escapeLabel(d.Name), escapeLabel(d.Driver))
+		set.add("logchain_destination_sent_total", "counter", "Events sent to a destination.", dl, float64(d.Sent))
+		set.add("logchain_destination_failed_total", "counter", "Events a destination failed to deliver after retries.", dl, float64(d.Failed))
+		set.add("logchain_dead_letter_events_total", "counter", "Events written to the dead-letter file.", dl, float64(d.DeadLettered))
+		set.add(droppedMetric, "counter", droppedHelp, dl+`,reason="queue_full"`, float64(d.Dropped))
+		set.add(droppedMetric, "counter", droppedHelp, dl+`,reason="undeliverable"`, float64(d.Lost))
+		if d.Spool != nil {
+			set.add("logchain_spool_bytes", "gauge", "Size of the spool segments on disk.", dl, float64(d.Spool.Bytes))
+			set.add("logchain_spool_events_total", "counter", "Events written to and replayed from the spool.", dl+`,state="spooled"`, float64(d.Spool.Spooled))
+			set.add("logchain_spool_events_total", "counter", "Events written to and replayed from the spool.", dl+`,state="replayed"`, float64(d.Spool.Replayed))
+			set.add(droppedMetric, "counter", droppedHelp, dl+`,reason="spool_full"`, float64(d.Spool.Dropped))
+		}
+	}
+}
+
+const (
+	droppedMetric = "logchain_dropped_events_total"
+	droppedHelp   = "Events dropped before reaching the destination."
+)
+
+// writeLatencies 输出按driver统计的发送耗时直方图
+func writeLatencies(b *bytes.Buffer) {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	const name = "logchain_delivery_duration_seconds"
+	fmt.Fprintf(b, "# HELP %s Time spent delivering a message or batch to a driver, including retries.\n", name)
+	fmt.Fprintf(b, "# TYPE %s histogram\n", name)
+	drivers := make([]string, 0, len(latencies))
+	for d := range latencies {
+		drivers = append(drivers, d)
+	}
+	sort.Strings(drivers)
+	for _, d := range drivers {
+		h := latencies[d]
+		driver := escapeLabel(d)
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(b, "%s_bucket{driver=\"%s\",le=\"%s\"} %d\n", name, driver, formatFloat(le), cum)
+		}
+		fmt.Fprintf(b, "%s_bucket{driver=\"%s\",le=\"+Inf\"} %d\n", name, driver, h.count)
+		fmt.Fprintf(b, "%s_sum{driver=\"%s\"} %s\n", name, driver, formatFloat(h.sum))
+		fmt.Fprintf(b, "%s_count{driver=\"%s\"} %d\n", name, driver, h.count)
+	}
+}
+
+// metricFamily 同名的一组样本, 相同标签的样本累加(合并到other的容器)
+type metricFamily struct {
+	name, typ, help string
+	labels          []string
+	values          map[string]float64
+}
+
+// metricSet 按照第一次添加的顺序输出的metricFamily
+type metricSet struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+func (s *metricSet) add(name, typ, help, labels string, v float64) {
+	if s.byName == nil {
+		s.byName = make(map[string]*metricFamily)
+	}
+	f := s.byName[name]
+	if f == nil {
+		f = &metricFamily{name: name, typ: typ, help: help, values: make(map[string]float64)}
+		s.byName[name] = f
+		s.families = append(s.families, f)
+	}
+	if _, ok := f.values[labels]; !ok {
+		f.labels = append(f.labels, labels)
+	}
+	f.values[labels] += v
+}
+
+// merge 将o中的样本加入s
+func (s *metricSet) merge(o *metricSet) {
+	for _, f := range o.families {
+		for _, l := range f.labels {
+			s.add(f.name, f.typ, f.help, l, f.values[l])
+		}
+	}
+}
+
+// counters 返回s中counter类型的样本
+func (s *metricSet) counters() metricSet {
+	var c metricSet
+	for _, f := range s.families {
+		if f.typ != "counter" {
+			continue
+		}
+		for _, l := range f.labels {
+			c.add(f.name, f.typ, f.help, l, f.values[l])
+		}
+	}
+	return c
+}
+
+func (s *metricSet) write(b *bytes.Buffer) {
+	for _, f := range s.families {
+		fmt.Fprintf(b, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.typ)
+		for _, l := range f.labels {
+			if l == "" {
+				fmt.Fprintf(b, "%s %s\n", f.name, formatFloat(f.values[l]))
+			} else {
+				fmt.Fprintf(b, "%s{%s} %s\n", f.name, l, formatFloat(f.values[l]))
+			}
+		}
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escapeLabel 按照Prometheus文本格式转义标签的值
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
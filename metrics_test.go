@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andy-zhangtao/logchain/logging"
+)
+
+// otherFrames 返回输出中other的logchain_frames_read_total
+func otherFrames(t *testing.T, b []byte) float64 {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "logchain_frames_read_total{"+otherLabels+"}") {
+			v, err := strconv.ParseFloat(line[strings.LastIndex(line, " ")+1:], 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+// TestMetricsOtherCumulative 合并到other的容器停止, 或者其它容器释放标签之后, other的counter不会减少
+func TestMetricsOtherCumulative(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lc := newTestLogChain()
+	m := newMetrics(lc, 1)
+	var writers []*os.File
+	var containers []logging.LogsRequest
+	for i := 0; i < 3; i++ {
+		lr, w := startContainer(t, lc, dir, i, map[string]string{})
+		writeEntries(t, w, "first", "second")
+		writers = append(writers, w)
+		containers = append(containers, lr)
+	}
+
+	// 第一个容器拥有自己的标签, 另外两个容器合并到other
+	deadline := time.Now().Add(5 * time.Second)
+	for otherFrames(t, m.render()) != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("other frames: got %v, want 4", otherFrames(t, m.render()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stop := func(i int) {
+		writers[i].Close()
+		if err := lc.HandlerStop(containers[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 停止一个other容器
+	stop(1)
+	if got := otherFrames(t, m.render()); got != 4 {
+		t.Errorf("after stopping an other container: got %v, want 4", got)
+	}
+
+	// 释放标签之后, 仍在运行的other容器不会获得标签
+	stop(0)
+	lr, w := startContainer(t, lc, dir, 3, map[string]string{})
+	defer lc.HandlerStop(lr)
+	defer w.Close()
+	if got := otherFrames(t, m.render()); got != 4 {
+		t.Errorf("after releasing a label: got %v, want 4", got)
+	}
+	stop(2)
+	if got := otherFrames(t, m.render()); got != 4 {
+		t.Errorf("after stopping all other containers: got %v, want 4", got)
+	}
+}
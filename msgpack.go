@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// 实现了fluentd forward协议需要的MessagePack编解码, 只支持日志中会出现的类型
+
+const (
+	// maxMsgpackLen 解码时str, bin和ext的最大长度, 服务端只会返回很小的ack
+	maxMsgpackLen = 1 << 20
+	// maxMsgpackItems 解码时array和map的最大元素个数
+	maxMsgpackItems = 1 << 16
+	// maxMsgpackDepth 解码时array和map的最大嵌套层数
+	maxMsgpackDepth = 32
+)
+
+// eventTime fluentd的EventTime扩展类型(ext type 0), 精确到纳秒
+type eventTime time.Time
+
+// appendMsgpack 将v编码后追加到b
+func appendMsgpack(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if v {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case int:
+		return appendMsgpackInt(b, int64(v))
+	case int32:
+		return appendMsgpackInt(b, int64(v))
+	case int64:
+		return appendMsgpackInt(b, v)
+	case uint32:
+		return appendMsgpackInt(b, int64(v))
+	case float64:
+		b = append(b, 0xcb)
+		return appendUint64(b, math.Float64bits(v))
+	case string:
+		return appendMsgpackString(b, v)
+	case []byte:
+		return appendMsgpackBin(b, v)
+	case time.Time:
+		return appendMsgpackString(b, v.Format(time.RFC3339Nano))
+	case eventTime:
+		t := time.Time(v)
+		b = append(b, 0xd7, 0x00)
+		b = appendUint32(b, uint32(t.Unix()))
+		return appendUint32(b, uint32(t.Nanosecond()))
+	case []interface{}:
+		b = appendMsgpackArrayHeader(b, len(v))
+		for _, e := range v {
+			b = appendMsgpack(b, e)
+		}
+		return b
+	case map[string]string:
+		b = appendMsgpackMapHeader(b, len(v))
+		for _, k := range sortedKeys(v) {
+			b = appendMsgpackString(b, k)
+			b = appendMsgpackString(b, v[k])
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendMsgpackMapHeader(b, len(v))
+		for _, k := range keys {
+			b = appendMsgpackString(b, k)
+			b = appendMsgpack(b, v[k])
+		}
+		return b
+	default:
+		return appendMsgpackString(b, fmt.Sprint(v))
+	}
+}
+
+func appendMsgpackInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		return append(b, byte(i))
+	case i < 0 && i >= -32:
+		return append(b, byte(i))
+	case i >= 0 && i <= math.MaxUint32:
+		b = append(b, 0xce)
+		return appendUint32(b, uint32(i))
+	default:
+		b = append(b, 0xd3)
+		return appendUint64(b, uint64(i))
+	}
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n <= 31:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xda)
+		b = appendUint16(b, uint16(n))
+	default:
+		b = append(b, 0xdb)
+		b = appendUint32(b, uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendMsgpackBin(b []byte, p []byte) []byte {
+	n := len(p)
+	switch {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xc5)
+		b = appendUint16(b, uint16(n))
+	default:
+		b = append(b, 0xc6)
+		b = appendUint32(b, uint32(n))
+	}
+	return append(b, p...)
+}
+
+func appendMsgpackArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xdc)
+		return appendUint16(b, uint16(n))
+	default:
+		b = append(b, 0xdd)
+		return appendUint32(b, uint32(n))
+	}
+}
+
+func appendMsgpackMapHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xde)
+		return appendUint16(b, uint16(n))
+	default:
+		b = append(b, 0xdf)
+		return appendUint32(b, uint32(n))
+	}
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+// decodeMsgpack 从r中读取一个值. map解码为map[string]interface{}, 整数解码为int64,
+// str解码为string, bin解码为[]byte, ext解码为eventTime(type 0)或者[]byte.
+// 长度超过maxMsgpackLen, maxMsgpackItems或者嵌套超过maxMsgpackDepth时返回错误
+func decodeMsgpack(r *bufio.Reader) (interface{}, error) {
+	return decodeMsgpackValue(r, 0)
+}
+
+func decodeMsgpackValue(r *bufio.Reader, depth int) (interface{}, error) {
+	if depth > maxMsgpackDepth {
+		return nil, fmt.Errorf("msgpack: nested deeper than %d", maxMsgpackDepth)
+	}
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return readMsgpackString(r, int(c&0x1f))
+	case c&0xf0 == 0x90:
+		return readMsgpackArray(r, int(c&0x0f), depth)
+	case c&0xf0 == 0x80:
+		return readMsgpackMap(r, int(c&0x0f), depth)
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := readMsgpackLen(r, c-0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackBytes(r, n)
+	case 0xca:
+		v, err := readMsgpackUint(r, 4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := readMsgpackUint(r, 8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := readMsgpackUint(r, 1<<(c-0xcc))
+		return int64(v), err
+	case 0xd0:
+		v, err := readMsgpackUint(r, 1)
+		return int64(int8(v)), err
+	case 0xd1:
+		v, err := readMsgpackUint(r, 2)
+		return int64(int16(v)), err
+	case 0xd2:
+		v, err := readMsgpackUint(r, 4)
+		return int64(int32(v)), err
+	case 0xd3:
+		v, err := readMsgpackUint(r, 8)
+		return int64(v), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return readMsgpackExt(r, 1<<(c-0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := readMsgpackLen(r, c-0xc7)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackExt(r, n)
+	case 0xd9, 0xda, 0xdb:
+		n, err := readMsgpackLen(r, c-0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackString(r, n)
+	case 0xdc, 0xdd:
+		n, err := readMsgpackLen(r, c-0xdc+1)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(r, n, depth)
+	case 0xde, 0xdf:
+		n, err := readMsgpackLen(r, c-0xde+1)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(r, n, depth)
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%x", c)
+}
+
+// readMsgpackLen 读取长度字段, size为0,1,2分别表示1,2,4个字节
+func readMsgpackLen(r *bufio.Reader, size byte) (int, error) {
+	v, err := readMsgpackUint(r, 1<<size)
+	if err == nil && v > maxMsgpackLen {
+		return 0, fmt.Errorf("msgpack: length %d exceeds %d", v, maxMsgpackLen)
+	}
+	return int(v), err
+}
+
+func readMsgpackUint(r *bufio.Reader, n int) (uint64, error) {
+	var p [8]byte
+	if _, err := io.ReadFull(r, p[8-n:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(p[:]), nil
+}
+
+func readMsgpackBytes(r *bufio.Reader, n int) ([]byte, error) {
+	p := make([]byte, n)
+	_, err := io.ReadFull(r, p)
+	return p, err
+}
+
+func readMsgpackString(r *bufio.Reader, n int) (interface{}, error) {
+	p, err := readMsgpackBytes(r, n)
+	return string(p), err
+}
+
+func readMsgpackExt(r *bufio.Reader, n int) (interface{}, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	p, err := readMsgpackBytes(r, n)
+	if err != nil {
+		return nil, err
+	}
+	if typ == 0 && n == 8 {
+		sec := binary.BigEndian.Uint32(p[:4])
+		nsec := binary.BigEndian.Uint32(p[4:])
+		return eventTime(time.Unix(int64(sec), int64(nsec))), nil
+	}
+	return p, nil
+}
+
+// readMsgpackArray 读取n个元素. 不按照声明的长度预先分配, 元素不存在时不会占用内存
+func readMsgpackArray(r *bufio.Reader, n, depth int) (interface{}, error) {
+	if n > maxMsgpackItems {
+		return nil, fmt.Errorf("msgpack: array of %d items exceeds %d", n, maxMsgpackItems)
+	}
+	a := make([]interface{}, 0, minInt(n, 16))
+	for i := 0; i < n; i++ {
+		v, err := decodeMsgpackValue(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+	return a, nil
+}
+
+func readMsgpackMap(r *bufio.Reader, n, depth int) (interface{}, error) {
+	if n > maxMsgpackItems {
+		return nil, fmt.Errorf("msgpack: map of %d items exceeds %d", n, maxMsgpackItems)
+	}
+	m := make(map[string]interface{}, minInt(n, 16))
+	for i := 0; i < n; i++ {
+		k, err := decodeMsgpackValue(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := decodeMsgpackValue(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		m[fmt.Sprint(k)] = v
+	}
+	return m, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
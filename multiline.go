@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// multiline 按照正则表达式判断日志行的归属, 语义与Filebeat的multiline相同:
+// multiline-pattern 匹配行的正则表达式
+// multiline-negate  为true时, 不匹配pattern的行才被视为续行
+// multiline-match   after: 续行追加到前一个事件; before: 续行并入后一个事件
+//
+// 例如Java日志每个事件以时间戳开头, 可以使用
+// multiline-pattern=^\d{4}-\d{2}-\d{2} multiline-negate=true multiline-match=after
+//
+// 也可以通过multiline-preset使用内置的堆栈规则, 见multilinePresets
+type multiline struct {
+	pattern *regexp.Regexp
+	negate  bool
+	before  bool
+	preset  *multilinePreset
+}
+
+// newMultiline 解析multiline参数, 没有设置multiline-pattern和multiline-preset时返回nil, 此时使用buf按行数合并
+func newMultiline(cfg map[string]string) (*multiline, error) {
+	if name := cfg["multiline-preset"]; name != "" {
+		if cfg["multiline-pattern"] != "" {
+			return nil, fmt.Errorf("multiline-preset and multiline-pattern can not be used together")
+		}
+		preset, ok := multilinePresets[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown multiline-preset %q", name)
+		}
+		return &multiline{preset: preset}, nil
+	}
+
+	p := cfg["multiline-pattern"]
+	if p == "" {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multiline-pattern %q: %v", p, err)
+	}
+
+	m := &multiline{pattern: re}
+
+	if v, ok := cfg["multiline-negate"]; ok {
+		m.negate, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("multiline-negate must be true or false, got %q", v)
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(cfg["multiline-match"])) {
+	case "", "after":
+	case "before":
+		m.before = true
+	default:
+		return nil, fmt.Errorf("multiline-match must be after or before, got %q", cfg["multiline-match"])
+	}
+
+	return m, nil
+}
+
+// cont 判断line是否为续行, state保存multiline-preset的堆栈状态, 每个stream独立
+func (m *multiline) cont(state *int, line []byte) bool {
+	if m.preset != nil {
+		return m.preset.cont(state, line)
+	}
+	return m.pattern.Match(line) != m.negate
+}
+
+const (
+	stateNone  = iota /*不在堆栈中*/
+	stateBlock        /*处于堆栈块中*/
+	stateTail         /*堆栈块刚刚以tail行结束*/
+)
+
+// multilinePreset 描述一种运行时的堆栈格式. 堆栈块由start或join行开启,
+// 块内匹配frame的行为续行, 匹配tail的行(例如Python的异常描述)结束堆栈块, 但仍属于当前事件
+type multilinePreset struct {
+	start *regexp.Regexp /*开启堆栈块, 并作为一个新事件的第一行*/
+	join  *regexp.Regexp /*开启堆栈块, 并追加到前一个事件*/
+	frame *regexp.Regexp /*堆栈块中的行*/
+	tail  *regexp.Regexp /*堆栈块的最后一行*/
+}
+
+func (p *multilinePreset) cont(state *int, line []byte) bool {
+	switch {
+	case *state == stateBlock && p.frame.Match(line):
+		return true
+	case *state == stateBlock && p.tail != nil && p.tail.Match(line):
+		*state = stateTail
+		return true
+	case *state == stateTail && p.frame.Match(line):
+		*state = stateBlock
+		return true
+	case p.start != nil && p.start.Match(line):
+		*state = stateBlock
+		return false
+	case p.join != nil && p.join.Match(line):
+		*state = stateBlock
+		return true
+	}
+	*state = stateNone
+	return false
+}
+
+// multilinePresets 内置的堆栈规则, 通过multiline-preset选择
+var multilinePresets = map[string]*multilinePreset{
+	// java.lang.IllegalStateException: boom
+	// 	at com.example.Foo.bar(Foo.java:10)
+	// 	... 3 more
+	// Caused by: java.io.IOException: closed
+	// 异常类名的行开始一个新事件, 只有孤立的at行追加到前一个事件
+	"java": {
+		start: regexp.MustCompile(`^Exception in thread "|^([a-z][\w$]*\.)+[A-Z][\w$]*(Exception|Error|Throwable)(: .*)?$`),
+		join:  regexp.MustCompile(`^\s+at `),
+		frame: regexp.MustCompile(`^\s+(at |\.\.\. \d+ (more|common frames omitted))|^\s*(Caused by|Suppressed): `),
+	},
+	// Traceback (most recent call last):
+	//   File "app.py", line 3, in <module>
+	//     main()
+	// ValueError: boom
+	// tail只匹配带有描述的异常类名, 或者以Error, Exception等结尾的类名
+	"python": {
+		join:  regexp.MustCompile(`^Traceback \(most recent call last\):$`),
+		frame: regexp.MustCompile(`^\s+\S|^$|^During handling of the above exception, another exception occurred:$|^The above exception was the direct cause of the following exception:$`),
+		tail:  regexp.MustCompile(`^([A-Za-z_]\w*\.)*[A-Z]\w*(: .*|(Error|Exception|Warning|Exit|Interrupt|Iteration))$`),
+	},
+	// panic: runtime error: index out of range
+	//
+	// goroutine 1 [running]:
+	// main.main()
+	// 	/app/main.go:8 +0x1d
+	// exit status 2
+	"go": {
+		start: regexp.MustCompile(`^(panic|fatal error): `),
+		frame: regexp.MustCompile(`^$|^goroutine \d+ .*\]:$|^\t|^\s+panic: |^\S+\(.*\)$|^created by |^\[signal |^\.\.\.additional frames elided\.\.\.$|^exit status \d+$`),
+	},
+	// TypeError: Cannot read properties of undefined (reading 'x')
+	//     at Object.<anonymous> (/app/index.js:1:5)
+	//   [cause]: Error: closed
+	"nodejs": {
+		start: regexp.MustCompile(`^(Uncaught )?\w*Error( \[\w+\])?: |^\w*Error$`),
+		join:  regexp.MustCompile(`^\s+at `),
+		frame: regexp.MustCompile(`^\s+(at |\.\.\. \d+ lines matching cause stack trace)|^\s*\[(cause|errors)\]: |^\s+\w+: |^\s*\}$`),
+	},
+	// Unhandled exception. System.InvalidOperationException: boom
+	//    at Program.Main(String[] args) in /src/Program.cs:line 10
+	//  ---> System.IO.IOException: closed
+	//    --- End of inner exception stack trace ---
+	"dotnet": {
+		start: regexp.MustCompile(`^Unhandled exception\. |^([A-Z]\w*\.)+[A-Z]\w*Exception(: .*)?$`),
+		join:  regexp.MustCompile(`^\s+at `),
+		frame: regexp.MustCompile(`^\s+at |^\s*---> |^\s*--- End of (inner exception|stack trace from previous location)`),
+	},
+	// app.rb:3:in 'foo': boom (RuntimeError)
+	// 	from app.rb:7:in '<main>'
+	"ruby": {
+		start: regexp.MustCompile(`^\S+:\d+:in .*\(\w+(::\w+)*\)$`),
+		join:  regexp.MustCompile(`^Traceback \(most recent call last\):$`),
+		frame: regexp.MustCompile(`^\s+(\d+: )?from \S+:\d+:in |^\s+\.\.\. \d+ levels\.\.\.$`),
+		tail:  regexp.MustCompile(`^\S+:\d+:in .*\(\w+(::\w+)*\)$`),
+	},
+}
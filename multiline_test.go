@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// captureLogger 记录收到的事件
+type captureLogger struct {
+	mu     sync.Mutex
+	lines  []string
+	attrs  []map[string]string
+	closed bool
+}
+
+func (c *captureLogger) Log(msg *logger.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lines = append(c.lines, string(msg.Line))
+	c.attrs = append(c.attrs, msg.Attrs)
+	return nil
+}
+
+func (c *captureLogger) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *captureLogger) Name() string {
+	return "capture"
+}
+
+func (c *captureLogger) events() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.lines...)
+}
+
+// TestMultilinePresets 按照preset合并testdata/multiline/<preset>.in, 与<preset>.golden比较.
+// golden中的事件以----分隔, 使用go test -update更新
+func TestMultilinePresets(t *testing.T) {
+	for name := range multilinePresets {
+		t.Run(name, func(t *testing.T) {
+			in, err := ioutil.ReadFile(filepath.Join("testdata", "multiline", name+".in"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ml, err := newMultiline(map[string]string{"multiline-preset": name})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := &captureLogger{}
+			lf := &logPair{driver: c, ml: ml, bufLines: 1, separator: "\n", groups: make(map[string]*lineGroup)}
+			s := bufio.NewScanner(bytes.NewReader(in))
+			for s.Scan() {
+				lf.groupLine(&logdriver.LogEntry{Source: "stdout", Line: []byte(s.Text())})
+			}
+			lf.flushAll()
+
+			got := strings.Join(c.events(), "\n----\n") + "\n"
+			golden := filepath.Join("testdata", "multiline", name+".golden")
+			if *update {
+				if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// defaultPauseBufferSize 暂停期间缓存事件的最大字节数, 超过后丢弃新的事件
+const defaultPauseBufferSize = 8 << 20
+
+// pauseLogger 通过admin API暂停和恢复发送. 暂停期间事件缓存在内存中, 恢复后按顺序发送;
+// 缓存满后丢弃新的事件并计数. Log在持有logPair.mu时调用, 不能等待恢复
+type pauseLogger struct {
+	driver   logger.Logger
+	maxBytes int
+
+	send sync.Mutex /*保证恢复时先发送缓存的事件*/
+
+	mu      sync.Mutex
+	paused  bool
+	held    []*logger.Message
+	bytes   int
+	dropped uint64 /*缓存满后丢弃的事件数*/
+}
+
+func withPause(l logger.Logger) *pauseLogger {
+	return &pauseLogger{driver: l, maxBytes: defaultPauseBufferSize}
+}
+
+func (p *pauseLogger) Log(msg *logger.Message) error {
+	p.mu.Lock()
+	if p.paused && len(p.held) > 0 && p.bytes+len(msg.Line) > p.maxBytes {
+		p.dropped++
+		p.mu.Unlock()
+		logger.PutMessage(msg)
+		return nil
+	}
+	if p.paused {
+		// driver.Log会回收msg, 缓存的事件需要复制
+		m := copyMessage(msg)
+		logger.PutMessage(msg)
+		p.held = append(p.held, m)
+		p.bytes += len(m.Line)
+		p.mu.Unlock()
+		return nil
+	}
+	p.mu.Unlock()
+
+	p.send.Lock()
+	defer p.send.Unlock()
+	return p.driver.Log(msg)
+}
+
+// pause 暂停发送
+func (p *pauseLogger) pause() {
+	p.mu.Lock()
+	p.paused = true
+	p.mu.Unlock()
+}
+
+// resume 恢复发送, 先发送暂停期间缓存的事件
+func (p *pauseLogger) resume() {
+	p.send.Lock()
+	defer p.send.Unlock()
+
+	p.mu.Lock()
+	held := p.held
+	p.held, p.bytes, p.paused = nil, 0, false
+	p.mu.Unlock()
+
+	for _, m := range held {
+		p.driver.Log(m)
+	}
+}
+
+// state 返回是否暂停以及缓存的事件数
+func (p *pauseLogger) state() (bool, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused, len(p.held)
+}
+
+// droppedEvents 返回缓存满后丢弃的事件数
+func (p *pauseLogger) droppedEvents() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dropped
+}
+
+// Close 发送缓存的事件后关闭driver
+func (p *pauseLogger) Close() error {
+	p.resume()
+	return p.driver.Close()
+}
+
+func (p *pauseLogger) Name() string {
+	return p.driver.Name()
+}
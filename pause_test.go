@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// TestPauseBufferFull 缓存满后Log不等待恢复, 丢弃新的事件并计数, 恢复后按顺序发送缓存的事件
+func TestPauseBufferFull(t *testing.T) {
+	c := &captureLogger{}
+	p := withPause(c)
+	p.maxBytes = 10
+	p.pause()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			m := logger.NewMessage()
+			m.Line = []byte(fmt.Sprintf("line %d", i))
+			if err := p.Log(m); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Log blocked while the pause buffer is full")
+	}
+
+	// 第一个事件总是缓存, 之后的事件超过maxBytes
+	if paused, held := p.state(); !paused || held != 1 {
+		t.Errorf("got paused %v with %d held, want 1 held", paused, held)
+	}
+	if got := p.droppedEvents(); got != 4 {
+		t.Errorf("got %d dropped, want 4", got)
+	}
+	if len(c.events()) != 0 {
+		t.Errorf("events sent while paused: %v", c.events())
+	}
+
+	p.resume()
+	m := logger.NewMessage()
+	m.Line = []byte("after")
+	if err := p.Log(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(c.events()); got != "[line 0 after]" {
+		t.Errorf("got events %s after resume", got)
+	}
+}
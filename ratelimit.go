@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/go-units"
+	"golang.org/x/time/rate"
+)
+
+const defaultRateLimitReportInterval = 10 * time.Second
+
+// rateLimiter 按容器限制发送给driver的事件数和字节数. 限制的是合并后的事件, 多行日志合并后只算一个事件.
+// 超过限制的事件被丢弃或者按照sample抽样发送, 每个report间隔发送一个事件报告被丢弃的数量
+type rateLimiter struct {
+	mu       sync.Mutex /*Log和report都会调用driver.Log*/
+	driver   logger.Logger
+	lines    *rate.Limiter
+	bytes    *rate.Limiter
+	sample   uint64
+	interval time.Duration
+	now      func() time.Time /*当前时间, 测试时替换*/
+	stop     chan struct{}
+	done     chan struct{}
+
+	excess        uint64 /*超过限制的事件, 用于抽样*/
+	windowLines   uint64 /*当前report间隔内丢弃的事件*/
+	windowBytes   uint64
+	suppressed    uint64 /*丢弃的事件总数*/
+	suppressedLen uint64
+	sampled       uint64 /*超过限制但是被抽样发送的事件*/
+}
+
+// withRateLimit 根据rate-limit-lines和rate-limit-bytes为l添加限速, 都未设置时返回l
+func withRateLimit(l logger.Logger, info logger.Info) (logger.Logger, error) {
+	cfg := info.Config
+	if cfg["rate-limit-lines"] == "" && cfg["rate-limit-bytes"] == "" {
+		for k := range cfg {
+			if strings.HasPrefix(k, "rate-limit-") {
+				return nil, fmt.Errorf("%s requires rate-limit-lines or rate-limit-bytes", k)
+			}
+		}
+		return l, nil
+	}
+
+	r := &rateLimiter{
+		driver:   l,
+		interval: defaultRateLimitReportInterval,
+		now:      time.Now,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if v := cfg["rate-limit-lines"]; v != "" {
+		limit, err := strconv.ParseFloat(v, 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("rate-limit-lines must be a positive number, got %q", v)
+		}
+		burst, err := parseInt(cfg, "rate-limit-lines-burst", int(math.Ceil(limit)))
+		if err != nil {
+			return nil, err
+		}
+		if burst < 1 {
+			return nil, fmt.Errorf("rate-limit-lines-burst must be a positive integer")
+		}
+		r.lines = rate.NewLimiter(rate.Limit(limit), burst)
+	}
+
+	if v := cfg["rate-limit-bytes"]; v != "" {
+		limit, err := units.RAMInBytes(v)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("rate-limit-bytes must be a positive size like 1m, got %q", v)
+		}
+		burst := limit
+		if v, ok := cfg["rate-limit-bytes-burst"]; ok {
+			if burst, err = units.RAMInBytes(v); err != nil || burst <= 0 {
+				return nil, fmt.Errorf("rate-limit-bytes-burst must be a positive size like 1m, got %q", v)
+			}
+		}
+		r.bytes = rate.NewLimiter(rate.Limit(limit), int(burst))
+	}
+
+	sample, err := parseInt(cfg, "rate-limit-sample", 0)
+	if err != nil {
+		return nil, err
+	}
+	r.sample = uint64(sample)
+
+	if d, err := parseDuration(cfg, "rate-limit-report-interval"); err != nil {
+		return nil, err
+	} else if d > 0 {
+		r.interval = d
+	}
+
+	go r.reportLoop()
+	return r, nil
+}
+
+func (r *rateLimiter) Log(msg *logger.Message) error {
+	if !r.allow(len(msg.Line)) {
+		r.mu.Lock()
+		r.excess++
+		sampled := r.sample > 0 && r.excess%r.sample == 0
+		if !sampled {
+			r.windowLines++
+			r.windowBytes += uint64(len(msg.Line))
+			atomic.AddUint64(&r.suppressed, 1)
+			atomic.AddUint64(&r.suppressedLen, uint64(len(msg.Line)))
+			r.mu.Unlock()
+			return nil
+		}
+		atomic.AddUint64(&r.sampled, 1)
+		r.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.driver.Log(msg)
+}
+
+// allow 两个限制都满足时才消耗token. 超过burst的事件按照burst计算, 否则永远不会被发送
+func (r *rateLimiter) allow(size int) bool {
+	now := r.now()
+	var lines *rate.Reservation
+	if r.lines != nil {
+		if lines = r.lines.ReserveN(now, 1); !lines.OK() || lines.DelayFrom(now) > 0 {
+			lines.CancelAt(now)
+			return false
+		}
+	}
+	if r.bytes != nil {
+		if size > r.bytes.Burst() {
+			size = r.bytes.Burst()
+		}
+		if b := r.bytes.ReserveN(now, size); !b.OK() || b.DelayFrom(now) > 0 {
+			b.CancelAt(now)
+			if lines != nil {
+				lines.CancelAt(now)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// reportLoop 每个interval报告一次被丢弃的事件
+func (r *rateLimiter) reportLoop() {
+	defer close(r.done)
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+			r.report()
+		}
+	}
+}
+
+// report 向driver发送一个事件, 报告上一个间隔中被丢弃的事件数
+func (r *rateLimiter) report() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.windowLines == 0 {
+		return
+	}
+	msg := &logger.Message{
+		Line:      []byte(fmt.Sprintf("logchain: %d lines (%s) suppressed by rate limit in the last %v", r.windowLines, units.HumanSize(float64(r.windowBytes)), r.interval)),
+		Source:    "stderr",
+		Timestamp: r.now(),
+		Attrs: map[string]string{
+			"rate_limited":     "true",
+			"suppressed_lines": strconv.FormatUint(r.windowLines, 10),
+			"suppressed_bytes": strconv.FormatUint(r.windowBytes, 10),
+		},
+	}
+	r.windowLines, r.windowBytes = 0, 0
+	r.driver.Log(msg)
+}
+
+// Close 报告最后一个间隔中被丢弃的事件后关闭driver
+func (r *rateLimiter) Close() error {
+	close(r.stop)
+	<-r.done
+	r.report()
+	return r.driver.Close()
+}
+
+func (r *rateLimiter) Name() string {
+	return r.driver.Name()
+}
+
+// RateLimitStats 限速的统计
+type RateLimitStats struct {
+	Suppressed      uint64 `json:"suppressed"`
+	SuppressedBytes uint64 `json:"suppressed_bytes"`
+	Sampled         uint64 `json:"sampled"`
+}
+
+func (r *rateLimiter) stats() RateLimitStats {
+	return RateLimitStats{
+		Suppressed:      atomic.LoadUint64(&r.suppressed),
+		SuppressedBytes: atomic.LoadUint64(&r.suppressedLen),
+		Sampled:         atomic.LoadUint64(&r.sampled),
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// fakeClock 测试使用的时钟, 只在advance时前进
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestRateLimiter(t *testing.T, cfg map[string]string) (*rateLimiter, *captureLogger, *fakeClock) {
+	c := &captureLogger{}
+	cfg["rate-limit-report-interval"] = "1h"
+	l, err := withRateLimit(c, logger.Info{Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{t: time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)}
+	r := l.(*rateLimiter)
+	r.now = clock.now
+	return r, c, clock
+}
+
+func logLines(t *testing.T, l logger.Logger, lines ...string) {
+	for _, line := range lines {
+		if err := l.Log(&logger.Message{Line: []byte(line), Source: "stdout"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestRateLimitLines burst之内的事件直接发送, 之后按照rate-limit-lines补充token
+func TestRateLimitLines(t *testing.T) {
+	r, c, clock := newTestRateLimiter(t, map[string]string{"rate-limit-lines": "2", "rate-limit-lines-burst": "4"})
+	defer r.Close()
+
+	logLines(t, r, "1", "2", "3", "4", "5", "6")
+	clock.advance(time.Second)
+	logLines(t, r, "7", "8", "9")
+
+	if got := strings.Join(c.events(), ","); got != "1,2,3,4,7,8" {
+		t.Errorf("got events %s", got)
+	}
+	if s := r.stats(); s.Suppressed != 3 || s.SuppressedBytes != 3 || s.Sampled != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+// TestRateLimitBytes 超过burst的事件按照burst计算, 不会永远被丢弃
+func TestRateLimitBytes(t *testing.T) {
+	r, c, clock := newTestRateLimiter(t, map[string]string{"rate-limit-bytes": "10"})
+	defer r.Close()
+
+	logLines(t, r, "12345678", "12345678")
+	clock.advance(time.Second)
+	logLines(t, r, strings.Repeat("x", 20), "y")
+
+	if got := c.events(); len(got) != 2 || got[0] != "12345678" || len(got[1]) != 20 {
+		t.Errorf("got events %q", got)
+	}
+	if s := r.stats(); s.Suppressed != 2 || s.SuppressedBytes != 9 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+// TestRateLimitSample 超过限制的事件每rate-limit-sample个发送一个
+func TestRateLimitSample(t *testing.T) {
+	r, c, _ := newTestRateLimiter(t, map[string]string{"rate-limit-lines": "1", "rate-limit-sample": "3"})
+	defer r.Close()
+
+	logLines(t, r, "1", "2", "3", "4", "5", "6", "7")
+	if got := strings.Join(c.events(), ","); got != "1,4,7" {
+		t.Errorf("got events %s", got)
+	}
+	if s := r.stats(); s.Suppressed != 4 || s.Sampled != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+// TestRateLimitReport 每个间隔报告一次丢弃的事件, 没有丢弃时不报告
+func TestRateLimitReport(t *testing.T) {
+	r, c, _ := newTestRateLimiter(t, map[string]string{"rate-limit-lines": "1"})
+
+	logLines(t, r, "first", "second", "third")
+	r.report()
+	r.report()
+	logLines(t, r, "fourth")
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := c.events()
+	if len(events) != 3 || events[0] != "first" {
+		t.Fatalf("got events %q", events)
+	}
+	for i, want := range []map[string]string{
+		{"rate_limited": "true", "suppressed_lines": "2", "suppressed_bytes": "11"},
+		{"rate_limited": "true", "suppressed_lines": "1", "suppressed_bytes": "6"},
+	} {
+		for k, v := range want {
+			if got := c.attrs[i+1][k]; got != v {
+				t.Errorf("report %d: %s = %q, want %q", i, k, got, v)
+			}
+		}
+	}
+	if !strings.Contains(events[1], "2 lines") {
+		t.Errorf("unexpected report %q", events[1])
+	}
+	if !c.closed {
+		t.Error("driver not closed")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// logOpts 命令行中重复出现的-opt key=value
+type logOpts map[string]string
+
+func (o logOpts) String() string {
+	return fmt.Sprint(map[string]string(o))
+}
+
+func (o logOpts) Set(v string) error {
+	p := strings.SplitN(v, "=", 2)
+	if len(p) != 2 || p[0] == "" {
+		return fmt.Errorf("option must be in form key=value, got %q", v)
+	}
+	o[p[0]] = p[1]
+	return nil
+}
+
+// redeliver 重新发送dead-letter文件中的事件, 例如:
+//
+//	logchain redeliver -opt driver=graylog -opt gelf-address=udp://graylog:12201 failed.ndjson
+//
+// 事件按照文件中的顺序发送, 每个容器使用单独的driver, 再次失败的事件写入-out指定的文件(默认为<file>.failed)
+func redeliver(args []string) error {
+	opts := logOpts{}
+	fs := flag.NewFlagSet("redeliver", flag.ContinueOnError)
+	fs.Var(opts, "opt", "log-opt of the destination driver in form key=value, can be repeated")
+	out := fs.String("out", "", "file to write events which fail again, default <file>.failed")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: logchain redeliver [-opt key=value]... [-out file] <dead-letter file>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("redeliver: exactly one dead-letter file is required")
+	}
+	if opts["driver"] == "" || opts["drivers"] != "" {
+		return fmt.Errorf("redeliver: -opt driver=<name> is required, drivers is not supported")
+	}
+
+	file := fs.Arg(0)
+	if *out == "" {
+		*out = file + ".failed"
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r := &redelivery{opts: opts, drivers: make(map[string]logger.Logger)}
+	defer r.close()
+
+	sent, err := r.run(in)
+	r.close()
+	if err != nil {
+		return err
+	}
+
+	if len(r.failed) > 0 {
+		if err := writeDeadLetters(*out, r.failed); err != nil {
+			return err
+		}
+		fmt.Printf("redelivered %d events, %d failed again and were written to %s\n", sent-len(r.failed), len(r.failed), *out)
+		return nil
+	}
+	fmt.Printf("redelivered %d events\n", sent)
+	return nil
+}
+
+// redelivery 一次重新发送, 按照容器创建driver并收集再次失败的事件
+type redelivery struct {
+	mu      sync.Mutex
+	opts    logOpts
+	drivers map[string]logger.Logger
+	records map[string]map[string][]*deadLetterRecord /*按容器ID和事件内容查找记录, batcher会复制消息*/
+	failed  []*deadLetterRecord
+}
+
+func (r *redelivery) run(in io.Reader) (int, error) {
+	r.records = make(map[string]map[string][]*deadLetterRecord)
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64<<10), 64<<20)
+
+	n := 0
+	for sc.Scan() {
+		if len(strings.TrimSpace(sc.Text())) == 0 {
+			continue
+		}
+		var rec deadLetterRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return n, fmt.Errorf("redeliver: invalid record at line %d: %v", n+1, err)
+		}
+
+		l, err := r.driver(&rec)
+		if err != nil {
+			return n, err
+		}
+		msg := &logger.Message{
+			Line:      []byte(rec.Line),
+			Source:    rec.Source,
+			Timestamp: rec.Time,
+			Attrs:     rec.Attrs,
+		}
+		r.mu.Lock()
+		records := r.records[rec.ContainerID]
+		if records == nil {
+			records = make(map[string][]*deadLetterRecord)
+			r.records[rec.ContainerID] = records
+		}
+		key := messageKey(msg)
+		records[key] = append(records[key], &rec)
+		r.mu.Unlock()
+
+		if _, ok := l.(batchedLogger); ok {
+			l.Log(msg)
+		} else if err := l.Log(copyMessage(msg)); err != nil {
+			r.fail(rec.ContainerID, []*logger.Message{msg}, err)
+		}
+		n++
+	}
+	return n, sc.Err()
+}
+
+// driver 返回容器对应的driver, 批量发送失败的事件通过batcher交给fail
+func (r *redelivery) driver(rec *deadLetterRecord) (logger.Logger, error) {
+	if l, ok := r.drivers[rec.ContainerID]; ok {
+		return l, nil
+	}
+
+	cfg := make(map[string]string, len(r.opts))
+	for k, v := range r.opts {
+		cfg[k] = v
+	}
+	info := logger.Info{
+		Config:        cfg,
+		ContainerID:   rec.ContainerID,
+		ContainerName: "/" + rec.ContainerName,
+	}
+	l, err := New(info)
+	if err != nil {
+		return nil, fmt.Errorf("redeliver: cannot create driver for container %s: %v", rec.ContainerName, err)
+	}
+	if b, ok := l.(batchedLogger); ok {
+		id := rec.ContainerID
+		b.batches().failed = func(msgs []*logger.Message, err error) {
+			r.fail(id, msgs, err)
+		}
+	}
+	r.drivers[rec.ContainerID] = l
+	return l, nil
+}
+
+// fail 找到容器id中与msgs对应的记录, 记录再次失败的原因
+func (r *redelivery) fail(id string, msgs []*logger.Message, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	records := r.records[id]
+	for _, m := range msgs {
+		key := messageKey(m)
+		if len(records[key]) == 0 {
+			continue
+		}
+		rec := records[key][0]
+		records[key] = records[key][1:]
+		rec.Error = err.Error()
+		rec.Permanent = isPermanent(err)
+		r.failed = append(r.failed, rec)
+	}
+}
+
+// messageKey 一个容器中事件的key, 包括时间, source, line和attrs. key相同的记录内容完全相同, 按顺序对应
+func messageKey(m *logger.Message) string {
+	keys := make([]string, 0, len(m.Attrs))
+	for k := range m.Attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d|%q|%q", m.Timestamp.UnixNano(), m.Source, m.Line)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "|%q=%q", k, m.Attrs[k])
+	}
+	return b.String()
+}
+
+// close 关闭所有driver, 发送缓存中剩余的事件
+func (r *redelivery) close() {
+	for id, l := range r.drivers {
+		l.Close()
+		delete(r.drivers, id)
+	}
+}
+
+func writeDeadLetters(path string, recs []*deadLetterRecord) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// TestRedeliverMatching 再次失败的事件对应到自己的记录, 不同容器中时间和内容相同的事件不会混淆
+func TestRedeliverMatching(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if bytes.Contains(body, []byte(`"container_name":"b"`)) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	ts := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	var in bytes.Buffer
+	enc := json.NewEncoder(&in)
+	for _, rec := range []deadLetterRecord{
+		{Time: ts, Source: "stdout", Line: "same", ContainerID: strings.Repeat("a", 64), ContainerName: "a", Driver: "http", Error: "timeout"},
+		{Time: ts, Source: "stdout", Line: "same", ContainerID: strings.Repeat("b", 64), ContainerName: "b", Driver: "http", Error: "timeout"},
+		{Time: ts, Source: "stdout", Line: "other", ContainerID: strings.Repeat("b", 64), ContainerName: "b", Driver: "http", Error: "timeout"},
+	} {
+		if err := enc.Encode(&rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &redelivery{
+		opts: logOpts{
+			"driver":             "http",
+			"http-url":           srv.URL,
+			"http-batch-size":    "1",
+			"retry-max-attempts": "1",
+		},
+		drivers: make(map[string]logger.Logger),
+	}
+	n, err := r.run(&in)
+	r.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d events, want 3", n)
+	}
+	if len(r.failed) != 2 {
+		t.Fatalf("got %d failed records, want 2", len(r.failed))
+	}
+	for _, rec := range r.failed {
+		if rec.ContainerName != "b" || rec.Error == "timeout" {
+			t.Errorf("unexpected failed record %+v", rec)
+		}
+	}
+	if r.failed[0].Line != "same" || r.failed[1].Line != "other" {
+		t.Errorf("failed records out of order: %q, %q", r.failed[0].Line, r.failed[1].Line)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	defaultRetryMaxBackoff = 30 * time.Second
+	defaultRetryJitter     = 0.2
+)
+
+// permanentError 不能通过重试解决的错误, 例如请求格式错误或者事件被目标拒绝
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// permanent 将err标记为不可重试的错误
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	_, ok := err.(*permanentError)
+	return ok
+}
+
+// deliveryFailure 一部分发送失败的事件以及失败的原因
+type deliveryFailure struct {
+	msgs []*logger.Message
+	err  error
+}
+
+// partialError 一批事件中只有部分事件发送失败, 不同的事件可能有不同的错误(例如bulk中单个文档被拒绝)
+type partialError struct {
+	failures []deliveryFailure
+}
+
+func (e *partialError) Error() string {
+	n := 0
+	for _, f := range e.failures {
+		n += len(f.msgs)
+	}
+	return fmt.Sprintf("%d events failed, first error: %v", n, e.failures[0].err)
+}
+
+// failures 将err展开为每部分事件的失败原因
+func failures(msgs []*logger.Message, err error) []deliveryFailure {
+	if p, ok := err.(*partialError); ok {
+		return p.failures
+	}
+	return []deliveryFailure{{msgs: msgs, err: err}}
+}
+
+// retryPolicy 发送失败时的重试策略: 最多attempts次, 每次等待base*2^n(不超过max), 并加上±jitter比例的随机抖动.
+// 不可重试的错误直接返回
+type retryPolicy struct {
+	attempts int
+	base     time.Duration
+	max      time.Duration
+	jitter   float64
+}
+
+// newRetryPolicy 解析重试参数retry-max-attempts, retry-base-backoff, retry-max-backoff和retry-jitter.
+// 为了兼容, <prefix>-max-retries(例如elasticsearch-max-retries)等价于retry-max-attempts=max-retries+1.
+// retries和base为driver的默认值
+func newRetryPolicy(cfg map[string]string, prefix string, retries int, base time.Duration) (*retryPolicy, error) {
+	var err error
+	if prefix != "" {
+		if retries, err = parseInt(cfg, prefix+"-max-retries", retries); err != nil {
+			return nil, err
+		}
+	}
+
+	p := &retryPolicy{
+		base:   base,
+		max:    defaultRetryMaxBackoff,
+		jitter: defaultRetryJitter,
+	}
+	if p.attempts, err = parseInt(cfg, "retry-max-attempts", retries+1); err != nil {
+		return nil, err
+	}
+	if p.attempts < 1 {
+		p.attempts = 1
+	}
+
+	if d, err := parseDuration(cfg, "retry-base-backoff"); err != nil {
+		return nil, err
+	} else if d > 0 {
+		p.base = d
+	}
+	if d, err := parseDuration(cfg, "retry-max-backoff"); err != nil {
+		return nil, err
+	} else if d > 0 {
+		p.max = d
+	}
+	if p.max < p.base {
+		p.max = p.base
+	}
+
+	if v, ok := cfg["retry-jitter"]; ok {
+		if p.jitter, err = strconv.ParseFloat(v, 64); err != nil || p.jitter < 0 || p.jitter > 1 {
+			return nil, fmt.Errorf("retry-jitter must be between 0 and 1, got %q", v)
+		}
+	}
+	return p, nil
+}
+
+// backoff 第attempt次(从0开始)失败后的等待时间
+func (p *retryPolicy) backoff(attempt int) time.Duration {
+	d := p.max
+	if attempt < 32 && p.base<<uint(attempt) < p.max {
+		d = p.base << uint(attempt)
+	}
+	if p.jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.jitter * float64(d))
+	}
+	return d
+}
+
+// do 调用send直到成功, 遇到不可重试的错误或者达到最大次数. 返回的错误以name为前缀, 并保留是否可以重试
+func (p *retryPolicy) do(name string, send func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := send()
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*partialError); ok {
+			return err
+		}
+		if isPermanent(err) {
+			return permanent(fmt.Errorf("%s: %v", name, err))
+		}
+		if attempt+1 >= p.attempts {
+			return fmt.Errorf("%s: %v (after %d attempts)", name, err, attempt+1)
+		}
+		// 插件退出超过期限时不再等待, 交给spool或者dead-letter
+		select {
+		case <-time.After(p.backoff(attempt)):
+		case <-aborted:
+			return fmt.Errorf("%s: %v (plugin is shutting down)", name, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRetryExhausted 达到最大次数后返回最后的错误, 不可重试的错误和部分失败不重试
+func TestRetryExhausted(t *testing.T) {
+	p, err := newRetryPolicy(map[string]string{"retry-max-attempts": "3", "retry-base-backoff": "1ms", "retry-jitter": "0"}, "", defaultDeliveryRetry, deliveryRetryBackoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	err = p.do("test", func() error {
+		calls++
+		return errors.New("connection refused")
+	})
+	if calls != 3 || err == nil || !strings.Contains(err.Error(), "after 3 attempts") || isPermanent(err) {
+		t.Errorf("got %d calls and %v, want 3 calls and a retryable error", calls, err)
+	}
+
+	calls = 0
+	err = p.do("test", func() error {
+		calls++
+		return permanent(errors.New("bad request"))
+	})
+	if calls != 1 || !isPermanent(err) {
+		t.Errorf("permanent error: got %d calls and %v", calls, err)
+	}
+
+	calls = 0
+	partial := &partialError{failures: []deliveryFailure{{err: errors.New("rejected")}}}
+	err = p.do("test", func() error {
+		calls++
+		return partial
+	})
+	if calls != 1 || err != partial {
+		t.Errorf("partial error: got %d calls and %v", calls, err)
+	}
+}
+
+// TestRetryBackoff 每次等待时间加倍, 不超过retry-max-backoff; 兼容<prefix>-max-retries
+func TestRetryBackoff(t *testing.T) {
+	p, err := newRetryPolicy(map[string]string{
+		"retry-base-backoff": "10ms",
+		"retry-max-backoff":  "50ms",
+		"retry-jitter":       "0",
+		"http-max-retries":   "4",
+	}, "http", 2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.attempts != 5 {
+		t.Errorf("got %d attempts, want 5", p.attempts)
+	}
+	for attempt, want := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond} {
+		if got := p.backoff(attempt); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+	if got := p.backoff(100); got != 50*time.Millisecond {
+		t.Errorf("backoff(100) = %v", got)
+	}
+
+	for _, v := range []string{"-0.1", "1.5", "x"} {
+		if _, err := newRetryPolicy(map[string]string{"retry-jitter": v}, "", 2, time.Second); err == nil {
+			t.Errorf("retry-jitter=%s accepted", v)
+		}
+	}
+}
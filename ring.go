@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/go-units"
+)
+
+const (
+	modeBlocking    = "blocking"
+	modeNonBlocking = "non-blocking"
+
+	defaultMaxBufferSize = 1 << 20
+	dropWarnInterval     = 10 * time.Second
+)
+
+var errRingClosed = errors.New("ring buffer is closed")
+
+// ringLogger mode=non-blocking时使用, 读取FIFO和发送之间使用有界的内存缓冲区,
+// 目标变慢时不再阻塞容器的stdout/stderr. 与Docker相同, 缓冲区满时丢弃新的事件
+type ringLogger struct {
+	driver logger.Logger
+	info   logger.Info
+	ring   *messageRing
+	done   chan struct{}
+
+	dropped      uint64 /*缓冲区满时丢弃的事件*/
+	droppedBytes uint64
+	lastWarn     int64 /*上一次输出丢弃警告的时间, 每dropWarnInterval最多输出一次*/
+}
+
+// withMode 根据mode和max-buffer-size参数, 在non-blocking模式下使用ringLogger包装l
+func withMode(l logger.Logger, info logger.Info) (logger.Logger, error) {
+	mode := info.Config["mode"]
+	switch mode {
+	case "", modeBlocking:
+		if _, ok := info.Config["max-buffer-size"]; ok {
+			return nil, fmt.Errorf("max-buffer-size is only supported with mode=%s", modeNonBlocking)
+		}
+		return l, nil
+	case modeNonBlocking:
+	default:
+		return nil, fmt.Errorf("mode must be %s or %s, got %q", modeBlocking, modeNonBlocking, mode)
+	}
+
+	maxSize := int64(defaultMaxBufferSize)
+	if v, ok := info.Config["max-buffer-size"]; ok {
+		size, err := units.RAMInBytes(v)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("max-buffer-size must be a positive size like 1m, got %q", v)
+		}
+		maxSize = size
+	}
+
+	r := &ringLogger{
+		driver: l,
+		info:   info,
+		ring:   newMessageRing(maxSize),
+		done:   make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+// Log 将msg放入缓冲区, 不等待发送
+func (r *ringLogger) Log(msg *logger.Message) error {
+	ok, err := r.ring.enqueue(msg)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		dropped := atomic.AddUint64(&r.dropped, 1)
+		atomic.AddUint64(&r.droppedBytes, uint64(len(msg.Line)))
+		now := time.Now().UnixNano()
+		last := atomic.LoadInt64(&r.lastWarn)
+		if now-last >= int64(dropWarnInterval) && atomic.CompareAndSwapInt64(&r.lastWarn, last, now) {
+			r.log().Warnf("buffer is full (max-buffer-size %s), %d events dropped so far", units.BytesSize(float64(r.ring.maxBytes)), dropped)
+		}
+	}
+	return nil
+}
+
+// run 从缓冲区取出事件发送给driver
+func (r *ringLogger) run() {
+	defer close(r.done)
+	for {
+		msg, err := r.ring.dequeue()
+		if err != nil {
+			return
+		}
+		if err := r.driver.Log(msg); err != nil && !isUndelivered(err) {
+			r.log().Errorf("error writing log message: %v", err)
+		}
+	}
+}
+
+// Close 停止接收新的事件, 发送缓冲区中剩余的事件后关闭driver
+func (r *ringLogger) Close() error {
+	r.ring.close()
+	<-r.done
+	for _, msg := range r.ring.drain() {
+		if err := r.driver.Log(msg); err != nil && !isUndelivered(err) {
+			r.log().Errorf("error writing log message: %v", err)
+		}
+	}
+	if dropped := atomic.LoadUint64(&r.dropped); dropped > 0 {
+		r.log().WithField("dropped_bytes", atomic.LoadUint64(&r.droppedBytes)).Warnf("%d events were dropped because the buffer was full", dropped)
+	}
+	return r.driver.Close()
+}
+
+func (r *ringLogger) Name() string {
+	return r.driver.Name()
+}
+
+func (r *ringLogger) log() *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{"driver": r.driver.Name(), "container": r.info.ContainerID})
+}
+
+// BufferStats non-blocking模式下缓冲区的统计
+type BufferStats struct {
+	Buffered      int    `json:"buffered"`
+	BufferedBytes int64  `json:"buffered_bytes"`
+	MaxBytes      int64  `json:"max_bytes"`
+	Dropped       uint64 `json:"dropped"`
+	DroppedBytes  uint64 `json:"dropped_bytes"`
+}
+
+func (r *ringLogger) stats() BufferStats {
+	n, size := r.ring.len()
+	return BufferStats{
+		Buffered:      n,
+		BufferedBytes: size,
+		MaxBytes:      r.ring.maxBytes,
+		Dropped:       atomic.LoadUint64(&r.dropped),
+		DroppedBytes:  atomic.LoadUint64(&r.droppedBytes),
+	}
+}
+
+// messageRing 按照日志内容的字节数限制大小的消息队列, 与vendor中daemon/logger/ring.go的实现相同,
+// enqueue额外返回事件是否被接受
+type messageRing struct {
+	mu   sync.Mutex
+	wait *sync.Cond /*有新的事件或者关闭时唤醒dequeue*/
+
+	sizeBytes int64
+	maxBytes  int64
+	queue     []*logger.Message
+	closed    bool
+}
+
+func newMessageRing(maxBytes int64) *messageRing {
+	r := &messageRing{maxBytes: maxBytes}
+	r.wait = sync.NewCond(&r.mu)
+	return r
+}
+
+// enqueue 将m放入队列, 超过maxBytes时返回false. 队列为空时即使m超过maxBytes也会放入
+func (r *messageRing) enqueue(m *logger.Message) (bool, error) {
+	size := int64(len(m.Line))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false, errRingClosed
+	}
+	if size+r.sizeBytes > r.maxBytes && len(r.queue) > 0 {
+		return false, nil
+	}
+	r.queue = append(r.queue, m)
+	r.sizeBytes += size
+	r.wait.Signal()
+	return true, nil
+}
+
+// dequeue 取出队列中的第一个事件, 队列为空时等待. 关闭后返回errRingClosed
+func (r *messageRing) dequeue() (*logger.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.queue) == 0 && !r.closed {
+		r.wait.Wait()
+	}
+	if r.closed {
+		return nil, errRingClosed
+	}
+
+	m := r.queue[0]
+	r.queue[0] = nil
+	r.queue = r.queue[1:]
+	r.sizeBytes -= int64(len(m.Line))
+	return m, nil
+}
+
+func (r *messageRing) len() (int, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.queue), r.sizeBytes
+}
+
+func (r *messageRing) close() {
+	r.mu.Lock()
+	r.closed = true
+	r.wait.Broadcast()
+	r.mu.Unlock()
+}
+
+// drain 取出队列中剩余的所有事件, 在close之后调用
+func (r *messageRing) drain() []*logger.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msgs := r.queue
+	r.queue = nil
+	r.sizeBytes = 0
+	return msgs
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// slowLogger 第一个事件等待release之后才返回
+type slowLogger struct {
+	captureLogger
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowLogger) Log(msg *logger.Message) error {
+	select {
+	case <-s.started:
+	default:
+		close(s.started)
+		<-s.release
+	}
+	return s.captureLogger.Log(msg)
+}
+
+// TestRingNonBlocking driver变慢时Log不阻塞, 缓冲区满后丢弃新的事件并计数, Close按顺序发送剩余的事件
+func TestRingNonBlocking(t *testing.T) {
+	s := &slowLogger{started: make(chan struct{}), release: make(chan struct{})}
+	l, err := withMode(s, logger.Info{Config: map[string]string{"mode": "non-blocking", "max-buffer-size": "10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := l.(*ringLogger)
+
+	logLines(t, r, "msg0")
+	select {
+	case <-s.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first event not sent")
+	}
+
+	// driver阻塞在msg0, 缓冲区只能放下两个事件
+	done := make(chan struct{})
+	go func() {
+		logLines(t, r, "msg1", "msg2", "msg3", "msg4")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Log blocked on a slow driver")
+	}
+
+	st := r.stats()
+	if st.Buffered != 2 || st.BufferedBytes != 8 || st.MaxBytes != 10 || st.Dropped != 2 || st.DroppedBytes != 8 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- r.Close() }()
+	time.Sleep(20 * time.Millisecond)
+	close(s.release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+
+	if got := strings.Join(s.events(), ","); got != "msg0,msg1,msg2" {
+		t.Errorf("got events %s, want msg0,msg1,msg2", got)
+	}
+	if !s.closed {
+		t.Error("driver not closed")
+	}
+	if err := r.Log(&logger.Message{Line: []byte("late")}); err != errRingClosed {
+		t.Errorf("Log after Close returned %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// defaultShutdownTimeout 插件退出时发送剩余事件的默认时间, Docker在SIGTERM之后等待插件退出的时间有限
+	defaultShutdownTimeout = 5 * time.Second
+	// shutdownGrace 超过期限后等待driver将剩余事件写入spool或者dead-letter文件的时间
+	shutdownGrace = 2 * time.Second
+)
+
+var (
+	shuttingDown = make(chan struct{}) /*插件开始退出时关闭*/
+	aborted      = make(chan struct{}) /*超过退出期限时关闭, 不再重试*/
+)
+
+func isShuttingDown() bool {
+	select {
+	case <-shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdownTimeout 解析环境变量SHUTDOWN_TIMEOUT
+func shutdownTimeout() (time.Duration, error) {
+	v := os.Getenv("SHUTDOWN_TIMEOUT")
+	if v == "" {
+		return defaultShutdownTimeout, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("SHUTDOWN_TIMEOUT must be a positive duration like 5s, got %q", v)
+	}
+	return d, nil
+}
+
+// handleSignals 收到SIGTERM或者SIGINT后发送所有容器中剩余的事件, 然后退出
+func handleSignals(lc *LogChain, timeout time.Duration) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-c
+	logrus.Infof("received %v, shutting down", sig)
+	lc.Shutdown(timeout)
+	os.Exit(0)
+}
+
+// Shutdown 不再接受新的容器, 发送所有容器未完成的事件并关闭driver.
+// 前一半的timeout用于读取FIFO中剩余的日志, 超过timeout后停止重试, 无法发送的事件写入spool; 没有开启spool时写入dead-letter文件
+func (lc *LogChain) Shutdown(timeout time.Duration) {
+	lc.mu.Lock()
+	if lc.closing {
+		lc.mu.Unlock()
+		return
+	}
+	lc.closing = true
+	close(shuttingDown)
+	pairs := make([]*logPair, 0, len(lc.logs))
+	for file, lf := range lc.logs {
+		pairs = append(pairs, lf)
+		delete(lc.logs, file)
+		delete(lc.idx, lf.info.ContainerID)
+	}
+	for _, lf := range pairs {
+		lc.wg.Add(1)
+		go func(lf *logPair) {
+			defer lc.wg.Done()
+			lf.pause.resume()
+			lf.interrupt(timeout / 2)
+			if err := lf.closeLoggers(); err != nil {
+				logrus.WithField("container", lf.info.ContainerID).Errorf("error closing logger: %v", err)
+			}
+		}(lf)
+	}
+	lc.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		lc.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logrus.Infof("flushed %d containers", len(pairs))
+		return
+	case <-time.After(timeout):
+	}
+
+	logrus.Warnf("containers are not flushed within %v, saving undelivered events", timeout)
+	close(aborted)
+	select {
+	case <-done:
+	case <-time.After(shutdownGrace):
+		logrus.Error("giving up flushing containers, some events may be lost")
+	}
+}
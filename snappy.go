@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// encodeSnappy 按照snappy的block格式压缩src(不带framing), Loki的push接口使用这种格式, Kafka在外面再加上xerial的header.
+// 使用简单的贪心匹配, 压缩率不如官方实现, 但输出可以被任何snappy实现解压
+func encodeSnappy(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(src)+len(src)/6+32)
+	n := binary.PutUvarint(dst, uint64(len(src)))
+	dst = dst[:n]
+
+	// snappy的copy只能引用64K以内的数据, 所以按64K分块压缩
+	for len(src) > 0 {
+		block := src
+		if len(block) > 1<<16 {
+			block = block[:1<<16]
+		}
+		dst = encodeSnappyBlock(dst, block)
+		src = src[len(block):]
+	}
+	return dst
+}
+
+func encodeSnappyBlock(dst, src []byte) []byte {
+	const minMatch = 4
+	if len(src) < minMatch+4 {
+		return appendSnappyLiteral(dst, src)
+	}
+
+	var table [1 << 14]int32
+	hash := func(u uint32) uint32 { return (u * 0x1e35a7bd) >> (32 - 14) }
+
+	lit := 0
+	for i := 0; i+minMatch <= len(src); {
+		u := binary.LittleEndian.Uint32(src[i:])
+		h := hash(u)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if cand < 0 || i-cand > 0xffff || binary.LittleEndian.Uint32(src[cand:]) != u {
+			i++
+			continue
+		}
+
+		n := minMatch
+		for i+n < len(src) && src[cand+n] == src[i+n] {
+			n++
+		}
+
+		dst = appendSnappyLiteral(dst, src[lit:i])
+		dst = appendSnappyCopy(dst, i-cand, n)
+		i += n
+		lit = i
+	}
+	return appendSnappyLiteral(dst, src[lit:])
+}
+
+func appendSnappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	default:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	}
+	return append(dst, lit...)
+}
+
+// appendSnappyCopy 使用2字节offset的copy, 每个copy最长64字节
+func appendSnappyCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte(n-1)<<2|0x02, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
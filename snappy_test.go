@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// decodeSnappy 按照snappy的block格式解压, 与encodeSnappy独立实现
+func decodeSnappy(src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 {
+		return nil, fmt.Errorf("invalid length")
+	}
+	src = src[k:]
+	dst := make([]byte, 0, n)
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			length = int(tag>>2) + 1
+			src = src[1:]
+			if extra := int(tag>>2) - 59; extra > 0 {
+				if len(src) < extra {
+					return nil, fmt.Errorf("truncated literal length")
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				length++
+				src = src[extra:]
+			}
+			if len(src) < length {
+				return nil, fmt.Errorf("truncated literal")
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, fmt.Errorf("truncated copy")
+			}
+			length = 4 + int(tag>>2)&7
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, fmt.Errorf("truncated copy")
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, fmt.Errorf("truncated copy")
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) {
+			return nil, fmt.Errorf("invalid copy offset %d", offset)
+		}
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, fmt.Errorf("got %d bytes, header says %d", len(dst), n)
+	}
+	return dst, nil
+}
+
+// decodeXerialSnappy 解压xerial格式: header之后是若干个[int32 长度][snappy block]
+func decodeXerialSnappy(src []byte) ([]byte, error) {
+	if !bytes.HasPrefix(src, xerialHeader) {
+		return nil, fmt.Errorf("missing xerial header")
+	}
+	src = src[len(xerialHeader):]
+	var dst []byte
+	for len(src) > 0 {
+		if len(src) < 4 {
+			return nil, fmt.Errorf("truncated chunk length")
+		}
+		n := int(binary.BigEndian.Uint32(src))
+		if len(src) < 4+n {
+			return nil, fmt.Errorf("truncated chunk")
+		}
+		chunk, err := decodeSnappy(src[4 : 4+n])
+		if err != nil {
+			return nil, err
+		}
+		dst = append(dst, chunk...)
+		src = src[4+n:]
+	}
+	return dst, nil
+}
+
+// compressionInputs 压缩测试使用的数据: 空, 短数据, 重复数据, 随机数据以及超过一个块的数据
+func compressionInputs() map[string][]byte {
+	random := make([]byte, 100<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	return map[string][]byte{
+		"empty":      nil,
+		"short":      []byte("abc"),
+		"repeated":   []byte(strings.Repeat("connection refused to 10.0.0.1:5432\n", 3000)),
+		"random":     random,
+		"long match": append([]byte("x"), bytes.Repeat([]byte("a"), 70<<10)...),
+	}
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	for name, in := range compressionInputs() {
+		got, err := decodeSnappy(encodeSnappy(in))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, in) {
+			t.Errorf("%s: round trip mismatch", name)
+		}
+
+		got, err = decodeXerialSnappy(encodeXerialSnappy(in))
+		if err != nil {
+			t.Errorf("%s: xerial: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, in) {
+			t.Errorf("%s: xerial round trip mismatch", name)
+		}
+	}
+
+	// 重复的数据需要被压缩
+	in := compressionInputs()["repeated"]
+	if n := len(encodeSnappy(in)); n > len(in)/10 {
+		t.Errorf("repeated data compressed to %d of %d bytes", n, len(in))
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/daemon/logger/loggerutils"
+)
+
+const (
+	splunkName            = "splunk"
+	splunkEventPath       = "/services/collector/event"
+	splunkAckPath         = "/services/collector/ack"
+	defaultSplunkBatch    = 1000
+	defaultSplunkBytes    = 1 << 20
+	defaultSplunkInterval = 5 * time.Second
+	defaultSplunkRetry    = 3
+	defaultSplunkAck      = 30 * time.Second
+	splunkRetryInterval   = 500 * time.Millisecond
+	splunkAckInterval     = 500 * time.Millisecond
+)
+
+// splunkLogger 通过HEC的/services/collector/event接口批量发送日志.
+// splunk-ack=true时使用indexer acknowledgement, 确认日志已经写入索引后才认为发送成功
+type splunkLogger struct {
+	client     *http.Client
+	url        string
+	token      string
+	format     string
+	index      string
+	source     string
+	sourcetype string
+	host       *nameTemplate
+	tag        string
+	fields     map[string]string
+	channel    string
+	ack        bool
+	ackTimeout time.Duration
+	retry      *retryPolicy
+	batch      *batcher
+}
+
+// splunkEvent HEC的一个事件
+type splunkEvent struct {
+	Time       string            `json:"time"`
+	Host       string            `json:"host"`
+	Source     string            `json:"source,omitempty"`
+	SourceType string            `json:"sourcetype,omitempty"`
+	Index      string            `json:"index,omitempty"`
+	Event      interface{}       `json:"event"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+// splunkInline splunk-format为inline和json时的event
+type splunkInline struct {
+	Line   interface{}       `json:"line"`
+	Source string            `json:"source"`
+	Tag    string            `json:"tag,omitempty"`
+	Attrs  map[string]string `json:"attrs,omitempty"`
+}
+
+// NewSplunk creates a splunk logger. The supported log opts are splunk-url, splunk-token,
+// splunk-index, splunk-source, splunk-sourcetype, splunk-host, splunk-format, splunk-ack,
+// splunk-ack-timeout, splunk-batch-size, splunk-batch-bytes, splunk-flush-interval,
+// splunk-max-retries, tag and the http client options.
+func NewSplunk(info logger.Info) (logger.Logger, error) {
+	cfg := info.Config
+
+	if cfg["splunk-url"] == "" {
+		return nil, fmt.Errorf("splunk: splunk-url is a required parameter")
+	}
+	if cfg["splunk-token"] == "" {
+		return nil, fmt.Errorf("splunk: splunk-token is a required parameter")
+	}
+	u := strings.TrimRight(cfg["splunk-url"], "/")
+	u = strings.TrimSuffix(u, splunkEventPath)
+	if _, err := url.ParseRequestURI(u); err != nil {
+		return nil, fmt.Errorf("splunk: invalid splunk-url %q: %v", cfg["splunk-url"], err)
+	}
+
+	s := &splunkLogger{
+		url:        u,
+		token:      cfg["splunk-token"],
+		format:     cfg["splunk-format"],
+		index:      cfg["splunk-index"],
+		source:     cfg["splunk-source"],
+		sourcetype: cfg["splunk-sourcetype"],
+		ackTimeout: defaultSplunkAck,
+	}
+
+	switch s.format {
+	case "":
+		s.format = "inline"
+	case "inline", "json", "raw":
+	default:
+		return nil, fmt.Errorf("splunk: unknown splunk-format %q, must be inline, json or raw", s.format)
+	}
+
+	var err error
+	if s.tag, err = loggerutils.ParseLogTag(info, loggerutils.DefaultTemplate); err != nil {
+		return nil, err
+	}
+
+	host := cfg["splunk-host"]
+	if host == "" {
+		host = "{{.Hostname}}"
+	}
+	if s.host, err = newNameTemplate(host, info); err != nil {
+		return nil, fmt.Errorf("splunk: %v", err)
+	}
+
+	// HEC的fields只支持字符串
+	extra, err := containerExtra(info, "")
+	if err != nil {
+		return nil, err
+	}
+	s.fields = make(map[string]string, len(extra))
+	for k, v := range extra {
+		s.fields[k] = fmt.Sprint(v)
+	}
+
+	if v, ok := cfg["splunk-ack"]; ok {
+		if s.ack, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("splunk: splunk-ack must be true or false")
+		}
+	}
+	if s.ack {
+		if s.channel, err = newChannelID(); err != nil {
+			return nil, fmt.Errorf("splunk: %v", err)
+		}
+	}
+	if d, err := parseDuration(cfg, "splunk-ack-timeout"); err != nil {
+		return nil, err
+	} else if d > 0 {
+		s.ackTimeout = d
+	}
+
+	if s.client, err = newHTTPClient(cfg, splunkName); err != nil {
+		return nil, fmt.Errorf("splunk: %v", err)
+	}
+
+	if s.retry, err = newRetryPolicy(cfg, splunkName, defaultSplunkRetry, splunkRetryInterval); err != nil {
+		return nil, fmt.Errorf("splunk: %v", err)
+	}
+
+	size, err := parseInt(cfg, "splunk-batch-size", defaultSplunkBatch)
+	if err != nil {
+		return nil, fmt.Errorf("splunk: %v", err)
+	}
+	maxBytes, err := parseInt(cfg, "splunk-batch-bytes", defaultSplunkBytes)
+	if err != nil {
+		return nil, fmt.Errorf("splunk: %v", err)
+	}
+	interval, err := parseDuration(cfg, "splunk-flush-interval")
+	if err != nil {
+		return nil, err
+	}
+	if interval == 0 {
+		interval = defaultSplunkInterval
+	}
+
+	s.batch = newBatcher(splunkName, size, interval, s.send)
+	s.batch.maxBytes = maxBytes
+	return s, nil
+}
+
+// newChannelID 生成indexer acknowledgement使用的channel(UUID格式)
+func newChannelID() (string, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func (s *splunkLogger) Log(msg *logger.Message) error {
+	err := s.batch.Add(msg)
+	logger.PutMessage(msg)
+	return err
+}
+
+// event 按照splunk-format生成HEC事件:
+// inline - line为字符串; json - line是合法的JSON时按JSON发送; raw - event为"tag attrs line"格式的字符串
+func (s *splunkLogger) event(msg *logger.Message) *splunkEvent {
+	e := &splunkEvent{
+		Time:       fmt.Sprintf("%d.%03d", msg.Timestamp.Unix(), msg.Timestamp.Nanosecond()/int(time.Millisecond)),
+		Host:       s.host.Name(msg.Timestamp),
+		Source:     s.source,
+		SourceType: s.sourcetype,
+		Index:      s.index,
+		Fields:     s.fields,
+	}
+	if len(msg.Attrs) > 0 {
+		e.Fields = make(map[string]string, len(s.fields)+len(msg.Attrs))
+		for k, v := range s.fields {
+			e.Fields[k] = v
+		}
+		for k, v := range msg.Attrs {
+			e.Fields[k] = v
+		}
+	}
+
+	switch s.format {
+	case "raw":
+		var b bytes.Buffer
+		if s.tag != "" {
+			b.WriteString(s.tag)
+			b.WriteByte(' ')
+		}
+		for _, k := range sortedKeys(msg.Attrs) {
+			fmt.Fprintf(&b, "%s=%s ", k, msg.Attrs[k])
+		}
+		b.Write(msg.Line)
+		e.Event = b.String()
+	case "json":
+		var line interface{} = string(msg.Line)
+		if json.Valid(msg.Line) {
+			line = json.RawMessage(msg.Line)
+		}
+		e.Event = &splunkInline{Line: line, Source: msg.Source, Tag: s.tag, Attrs: msg.Attrs}
+	default:
+		e.Event = &splunkInline{Line: string(msg.Line), Source: msg.Source, Tag: s.tag, Attrs: msg.Attrs}
+	}
+	return e
+}
+
+// send 发送一批事件, 网络错误, 429和5xx按照重试策略重试, 其它错误不再重试.
+// 开启ack时等待所有事件被确认, 超时后重新发送
+func (s *splunkLogger) send(msgs []*logger.Message) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, m := range msgs {
+		if err := enc.Encode(s.event(m)); err != nil {
+			return permanent(fmt.Errorf("splunk: %v", err))
+		}
+	}
+
+	return s.retry.do(splunkName, func() error {
+		ackID, retry, err := s.post(body.Bytes())
+		if err != nil && !retry {
+			return permanent(err)
+		}
+		if err == nil && s.ack {
+			// 没有被确认的事件需要重新发送
+			err = s.waitAck(ackID)
+		}
+		return err
+	})
+}
+
+// post 发送一次请求, 返回ackId以及错误是否可以重试
+func (s *splunkLogger) post(body []byte) (int64, bool, error) {
+	resp, err := s.request(s.url+splunkEventPath, body)
+	if err != nil {
+		return 0, true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return 0, retry, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	var result struct {
+		AckID int64 `json:"ackId"`
+	}
+	if !s.ack {
+		io.Copy(ioutil.Discard, resp.Body)
+		return 0, false, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, true, fmt.Errorf("cannot decode response: %v", err)
+	}
+	return result.AckID, false, nil
+}
+
+// waitAck 轮询/services/collector/ack直到ackID被确认
+func (s *splunkLogger) waitAck(ackID int64) error {
+	body, _ := json.Marshal(map[string][]int64{"acks": {ackID}})
+	deadline := time.Now().Add(s.ackTimeout)
+	for {
+		resp, err := s.request(s.url+splunkAckPath+"?channel="+s.channel, body)
+		if err == nil {
+			var result struct {
+				Acks map[string]bool `json:"acks"`
+			}
+			if resp.StatusCode == http.StatusOK {
+				err = json.NewDecoder(resp.Body).Decode(&result)
+			} else {
+				err = fmt.Errorf("ack request failed with status %d", resp.StatusCode)
+			}
+			resp.Body.Close()
+			if err == nil && result.Acks[strconv.FormatInt(ackID, 10)] {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("ack %d not confirmed: %v", ackID, err)
+			}
+			return fmt.Errorf("ack %d not confirmed in %s", ackID, s.ackTimeout)
+		}
+		time.Sleep(splunkAckInterval)
+	}
+}
+
+func (s *splunkLogger) request(u string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Splunk "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+	if s.channel != "" {
+		req.Header.Set("X-Splunk-Request-Channel", s.channel)
+	}
+	return s.client.Do(req)
+}
+
+func (s *splunkLogger) Close() error {
+	return s.batch.Close()
+}
+
+func (s *splunkLogger) batches() *batcher {
+	return s.batch
+}
+
+func (s *splunkLogger) Name() string {
+	return splunkName
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+func newTestSplunk(t *testing.T, url string, cfg map[string]string) *splunkLogger {
+	cfg["splunk-url"] = url
+	cfg["splunk-token"] = "00000000-0000-0000-0000-000000000000"
+	cfg["retry-base-backoff"] = "1ms"
+	l, err := NewSplunk(logger.Info{
+		ContainerID:   "0123456789abcdef0123456789abcdef",
+		ContainerName: "/web",
+		Config:        cfg,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.(*splunkLogger)
+}
+
+// TestSplunkFormats 三种splunk-format的event, 请求带有HEC token, host按照事件的时间生成
+func TestSplunkFormats(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != splunkEventPath || r.Header.Get("Authorization") != "Splunk 00000000-0000-0000-0000-000000000000" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	ts := time.Date(2024, 3, 5, 10, 0, 0, 250000000, time.UTC)
+	msgs := []*logger.Message{{Line: []byte(`{"status":200}`), Source: "stdout", Timestamp: ts, Attrs: map[string]string{"team": "web"}}}
+	for format, want := range map[string]string{
+		"inline": `{"line":"{\"status\":200}","source":"stdout","tag":"0123456789ab","attrs":{"team":"web"}}`,
+		"json":   `{"line":{"status":200},"source":"stdout","tag":"0123456789ab","attrs":{"team":"web"}}`,
+		"raw":    `"0123456789ab team=web {\"status\":200}"`,
+	} {
+		s := newTestSplunk(t, srv.URL+splunkEventPath, map[string]string{
+			"splunk-format": format,
+			"splunk-host":   "{{.ContainerName}}-2006.01.02",
+			"splunk-index":  "main",
+		})
+		if err := s.send(msgs); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		s.Close()
+
+		mu.Lock()
+		body := bodies[len(bodies)-1]
+		mu.Unlock()
+		var e struct {
+			Time   string            `json:"time"`
+			Host   string            `json:"host"`
+			Index  string            `json:"index"`
+			Event  json.RawMessage   `json:"event"`
+			Fields map[string]string `json:"fields"`
+		}
+		if err := json.Unmarshal([]byte(body), &e); err != nil {
+			t.Fatalf("%s: %v in %q", format, err, body)
+		}
+		if string(e.Event) != want {
+			t.Errorf("%s: got event %s, want %s", format, e.Event, want)
+		}
+		if e.Time != "1709632800.250" || e.Host != "web-2024.03.05" || e.Index != "main" {
+			t.Errorf("%s: got time %q, host %q, index %q", format, e.Time, e.Host, e.Index)
+		}
+		if e.Fields["container_name"] != "web" || e.Fields["team"] != "web" {
+			t.Errorf("%s: got fields %v", format, e.Fields)
+		}
+	}
+}
+
+// TestSplunkAck 开启splunk-ack时轮询ack接口, 事件被确认后send才返回
+func TestSplunkAck(t *testing.T) {
+	var mu sync.Mutex
+	var channels []string
+	polls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		channels = append(channels, r.Header.Get("X-Splunk-Request-Channel"))
+		switch r.URL.Path {
+		case splunkEventPath:
+			w.Write([]byte(`{"text":"Success","code":0,"ackId":7}`))
+		case splunkAckPath:
+			var req struct {
+				Acks []int64 `json:"acks"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			if len(req.Acks) != 1 || req.Acks[0] != 7 || r.URL.Query().Get("channel") != channels[0] {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			// 第二次查询时确认
+			polls++
+			w.Write([]byte(`{"acks":{"7":` + strconv.FormatBool(polls > 1) + `}}`))
+		}
+	}))
+	defer srv.Close()
+
+	s := newTestSplunk(t, srv.URL, map[string]string{"splunk-ack": "true"})
+	defer s.Close()
+	if err := s.send(testMessages("acked")); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if polls != 2 {
+		t.Errorf("got %d ack polls, want 2", polls)
+	}
+	if len(channels) != 3 || channels[0] == "" || strings.Count(strings.Join(channels, ","), channels[0]) != 3 {
+		t.Errorf("requests used channels %q, want one channel", channels)
+	}
+}
+
+// TestSplunkAckTimeout 超时没有确认的事件作为可以重试的错误返回
+func TestSplunkAckTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == splunkEventPath {
+			w.Write([]byte(`{"ackId":1}`))
+			return
+		}
+		w.Write([]byte(`{"acks":{"1":false}}`))
+	}))
+	defer srv.Close()
+
+	s := newTestSplunk(t, srv.URL, map[string]string{"splunk-ack": "true", "splunk-ack-timeout": "10ms", "retry-max-attempts": "1"})
+	defer s.Close()
+	err := s.send(testMessages("lost"))
+	if err == nil || isPermanent(err) || !strings.Contains(err.Error(), "not confirmed") {
+		t.Errorf("got %v, want a retryable ack timeout", err)
+	}
+}
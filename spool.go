@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/go-units"
+)
+
+const (
+	defaultStateDir      = "/var/lib/logchain"
+	defaultSpoolMaxSize  = 128 << 20
+	defaultSpoolRetry    = 5 * time.Second
+	spoolMaxSegment      = 16 << 20
+	spoolReplayBatch     = 100
+	spoolRecordHeaderLen = 8
+	spoolCursorFile      = "cursor"
+	spoolSegmentExt      = ".seg"
+)
+
+// stateDir 插件的状态目录, 可以通过STATE_DIR环境变量修改.
+// 目录位于插件的rootfs中, 插件重启之后仍然存在
+func stateDir() string {
+	if d := os.Getenv("STATE_DIR"); d != "" {
+		return d
+	}
+	return defaultStateDir
+}
+
+// spoolRecord spool中保存的一个事件
+type spoolRecord struct {
+	Line   []byte            `json:"line"`
+	Source string            `json:"source"`
+	Time   int64             `json:"time"`
+	Attrs  map[string]string `json:"attrs,omitempty"`
+}
+
+// spoolPos spool中的位置: segment编号和segment内的偏移
+type spoolPos struct {
+	seg int64
+	off int64
+}
+
+type spoolSegment struct {
+	id      int64
+	size    int64
+	records int
+}
+
+// spool 磁盘上的写前日志, 由多个segment文件组成. 每条记录的格式为[uint32 长度][uint32 crc32][JSON],
+// cursor文件记录已经发送成功的位置. 总大小超过maxSize时丢弃最早的segment或者新的事件
+type spool struct {
+	mu         sync.Mutex
+	dir        string
+	maxSize    int64
+	segSize    int64
+	dropOldest bool
+	segs       []*spoolSegment
+	w          *os.File /*最后一个segment*/
+	cursor     spoolPos
+	size       int64
+	retry      time.Duration /*重新发送的间隔*/
+
+	spooled  uint64
+	replayed uint64
+	dropped  uint64
+}
+
+// openSpool 打开dir中的spool, 校验每个segment并截断末尾不完整的记录
+func openSpool(dir string, maxSize int64, dropOldest bool) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		dir:        dir,
+		maxSize:    maxSize,
+		segSize:    maxSize / 4,
+		dropOldest: dropOldest,
+	}
+	if s.segSize > spoolMaxSegment {
+		s.segSize = spoolMaxSegment
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), spoolSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(fi.Name(), spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg := &spoolSegment{id: id}
+		if seg.size, seg.records, err = s.check(id); err != nil {
+			return nil, err
+		}
+		s.segs = append(s.segs, seg)
+		s.size += seg.size
+	}
+	sort.Slice(s.segs, func(i, j int) bool { return s.segs[i].id < s.segs[j].id })
+
+	if len(s.segs) == 0 {
+		s.segs = append(s.segs, &spoolSegment{id: 1})
+	}
+	last := s.segs[len(s.segs)-1]
+	if s.w, err = os.OpenFile(s.segment(last.id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return nil, err
+	}
+
+	s.cursor = spoolPos{seg: s.segs[0].id}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, spoolCursorFile)); err == nil && len(b) == 16 {
+		pos := spoolPos{seg: int64(binary.BigEndian.Uint64(b)), off: int64(binary.BigEndian.Uint64(b[8:]))}
+		for _, seg := range s.segs {
+			if seg.id == pos.seg && pos.off <= seg.size {
+				s.cursor = pos
+			}
+		}
+	}
+	s.advance()
+	return s, nil
+}
+
+func (s *spool) segment(id int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, spoolSegmentExt))
+}
+
+// check 校验segment中的记录, 返回有效部分的长度和记录数. 插件在写入时退出会留下不完整的记录, 需要截断
+func (s *spool) check(id int64) (int64, int, error) {
+	f, err := os.OpenFile(s.segment(id), os.O_RDWR, 0600)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var size int64
+	records := 0
+	for {
+		_, n, err := readSpoolRecord(r)
+		if err != nil {
+			break
+		}
+		size += int64(n)
+		records++
+	}
+	if fi, err := f.Stat(); err == nil && fi.Size() != size {
+		logrus.WithField("spool", s.dir).Warnf("truncating segment %d from %d to %d bytes", id, fi.Size(), size)
+		if err := f.Truncate(size); err != nil {
+			return 0, 0, err
+		}
+	}
+	return size, records, nil
+}
+
+// readSpoolRecord 读取一条记录, 返回记录和占用的字节数
+func readSpoolRecord(r *bufio.Reader) (*spoolRecord, int, error) {
+	var head [spoolRecordHeaderLen]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, 0, err
+	}
+	n := binary.BigEndian.Uint32(head[:4])
+	if n > spoolMaxSegment {
+		return nil, 0, fmt.Errorf("invalid record length %d", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(head[4:]) {
+		return nil, 0, fmt.Errorf("record checksum mismatch")
+	}
+	var rec spoolRecord
+	if err := json.Unmarshal(body, &rec); err != nil {
+		return nil, 0, err
+	}
+	return &rec, spoolRecordHeaderLen + int(n), nil
+}
+
+// empty 是否所有的记录都已经发送成功
+func (s *spool) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.emptyLocked()
+}
+
+func (s *spool) emptyLocked() bool {
+	last := s.segs[len(s.segs)-1]
+	return s.cursor.seg == last.id && s.cursor.off == last.size
+}
+
+// append 将事件追加到spool, 返回之前写入的内容已经同步到磁盘
+func (s *spool) append(msgs []*logger.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	written := false
+	for _, m := range msgs {
+		body, err := json.Marshal(&spoolRecord{Line: m.Line, Source: m.Source, Time: m.Timestamp.UnixNano(), Attrs: m.Attrs})
+		if err != nil {
+			return err
+		}
+		rec := make([]byte, spoolRecordHeaderLen, spoolRecordHeaderLen+len(body))
+		binary.BigEndian.PutUint32(rec, uint32(len(body)))
+		binary.BigEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(body))
+		rec = append(rec, body...)
+		n := int64(len(rec))
+
+		if n > s.segSize {
+			atomic.AddUint64(&s.dropped, 1)
+			continue
+		}
+		for s.size+n > s.maxSize && s.dropOldest {
+			if err := s.dropSegment(); err != nil {
+				return err
+			}
+		}
+		if s.size+n > s.maxSize {
+			atomic.AddUint64(&s.dropped, 1)
+			continue
+		}
+
+		last := s.segs[len(s.segs)-1]
+		if last.size+n > s.segSize {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+			last = s.segs[len(s.segs)-1]
+		}
+		if _, err := s.w.Write(rec); err != nil {
+			return err
+		}
+		last.size += n
+		last.records++
+		s.size += n
+		written = true
+		atomic.AddUint64(&s.spooled, 1)
+	}
+	if written {
+		return s.w.Sync()
+	}
+	return nil
+}
+
+// rotate 创建新的segment用于写入
+func (s *spool) rotate() error {
+	id := s.segs[len(s.segs)-1].id + 1
+	w, err := os.OpenFile(s.segment(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.w.Sync()
+	s.w.Close()
+	s.w = w
+	s.segs = append(s.segs, &spoolSegment{id: id})
+	return nil
+}
+
+// dropSegment 删除最早的segment, 其中还没有发送的记录计入dropped
+func (s *spool) dropSegment() error {
+	if len(s.segs) == 1 {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	seg := s.segs[0]
+	lost := seg.records
+	if s.cursor.seg == seg.id {
+		lost -= s.countBefore(seg.id, s.cursor.off)
+	}
+	atomic.AddUint64(&s.dropped, uint64(lost))
+
+	if err := os.Remove(s.segment(seg.id)); err != nil {
+		return err
+	}
+	s.segs = s.segs[1:]
+	s.size -= seg.size
+	if s.cursor.seg <= seg.id {
+		s.cursor = spoolPos{seg: s.segs[0].id}
+	}
+	return s.writeCursor()
+}
+
+// countBefore 返回segment中off之前的记录数
+func (s *spool) countBefore(id, off int64) int {
+	f, err := os.Open(s.segment(id))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	r := bufio.NewReader(io.LimitReader(f, off))
+	n := 0
+	for {
+		if _, _, err := readSpoolRecord(r); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+// read 从cursor开始读取最多n条记录, 返回记录以及这些记录之后的位置, 调用ack后才会移动cursor
+func (s *spool) read(n int) ([]*logger.Message, spoolPos, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pos := s.cursor
+	var msgs []*logger.Message
+	for i, seg := range s.segs {
+		if seg.id < pos.seg {
+			continue
+		}
+		if pos.off >= seg.size {
+			if i+1 < len(s.segs) {
+				pos = spoolPos{seg: s.segs[i+1].id}
+			}
+			continue
+		}
+
+		f, err := os.Open(s.segment(seg.id))
+		if err != nil {
+			return nil, pos, err
+		}
+		if _, err := f.Seek(pos.off, io.SeekStart); err != nil {
+			f.Close()
+			return nil, pos, err
+		}
+		r := bufio.NewReader(io.LimitReader(f, seg.size-pos.off))
+		for len(msgs) < n {
+			rec, size, err := readSpoolRecord(r)
+			if err != nil {
+				break
+			}
+			msgs = append(msgs, &logger.Message{
+				Line:      rec.Line,
+				Source:    rec.Source,
+				Timestamp: time.Unix(0, rec.Time),
+				Attrs:     rec.Attrs,
+			})
+			pos.off += int64(size)
+		}
+		f.Close()
+
+		if len(msgs) >= n {
+			break
+		}
+		if i+1 < len(s.segs) {
+			pos = spoolPos{seg: s.segs[i+1].id}
+		}
+	}
+	return msgs, pos, nil
+}
+
+// ack 记录pos之前的事件已经发送成功, 删除不再需要的segment.
+// 发送期间pos所在的segment可能已经被dropSegment删除, 此时cursor已经移到剩下的segment, 不再移动
+func (s *spool) ack(pos spoolPos, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	atomic.AddUint64(&s.replayed, uint64(n))
+	if pos.seg < s.segs[0].id {
+		return nil
+	}
+	s.cursor = pos
+	s.advance()
+
+	for len(s.segs) > 1 && s.segs[0].id < s.cursor.seg {
+		if err := os.Remove(s.segment(s.segs[0].id)); err != nil {
+			return err
+		}
+		s.size -= s.segs[0].size
+		s.segs = s.segs[1:]
+	}
+
+	// 全部发送成功后从新的segment开始, 释放磁盘空间
+	if s.emptyLocked() && s.size > 0 {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		old := s.segs[0]
+		if err := os.Remove(s.segment(old.id)); err != nil {
+			return err
+		}
+		s.segs = s.segs[1:]
+		s.size = 0
+		s.cursor = spoolPos{seg: s.segs[0].id}
+	}
+	return s.writeCursor()
+}
+
+// advance cursor位于segment末尾时移动到下一个segment的开始
+func (s *spool) advance() {
+	for i, seg := range s.segs {
+		if seg.id == s.cursor.seg && s.cursor.off >= seg.size && i+1 < len(s.segs) {
+			s.cursor = spoolPos{seg: s.segs[i+1].id}
+		}
+	}
+}
+
+// writeCursor 通过rename原子地更新cursor文件, 返回时文件和目录都已经同步到磁盘
+func (s *spool) writeCursor() error {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:], uint64(s.cursor.seg))
+	binary.BigEndian.PutUint64(b[8:], uint64(s.cursor.off))
+	tmp := filepath.Join(s.dir, spoolCursorFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b[:]); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, spoolCursorFile)); err != nil {
+		return err
+	}
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// close 关闭spool, 所有事件都已经发送时删除spool目录
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.w.Sync()
+	err := s.w.Close()
+	if s.emptyLocked() {
+		return os.RemoveAll(s.dir)
+	}
+	return err
+}
+
+// SpoolStats spool的统计, Bytes为磁盘上segment的总大小
+type SpoolStats struct {
+	Bytes    int64  `json:"bytes"`
+	Spooled  uint64 `json:"spooled"`
+	Replayed uint64 `json:"replayed"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+func (s *spool) stats() SpoolStats {
+	s.mu.Lock()
+	size := s.size
+	s.mu.Unlock()
+	return SpoolStats{
+		Bytes:    size,
+		Spooled:  atomic.LoadUint64(&s.spooled),
+		Replayed: atomic.LoadUint64(&s.replayed),
+		Dropped:  atomic.LoadUint64(&s.dropped),
+	}
+}
+
+// newSpool 根据spool参数打开容器的spool, 未开启时返回nil.
+// name 区分同一个容器的多个目标, spool位于<STATE_DIR>/spool/<容器ID>/<name>
+func newSpool(info logger.Info, name string) (*spool, error) {
+	cfg := info.Config
+
+	enabled := false
+	if v, ok := cfg["spool"]; ok {
+		var err error
+		if enabled, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("spool must be true or false, got %q", v)
+		}
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	maxSize := int64(defaultSpoolMaxSize)
+	if v, ok := cfg["spool-max-size"]; ok {
+		size, err := units.RAMInBytes(v)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("spool-max-size must be a positive size like 128m, got %q", v)
+		}
+		maxSize = size
+	}
+
+	dropOldest := true
+	switch cfg["spool-overflow"] {
+	case "", "drop-oldest":
+	case "drop-newest":
+		dropOldest = false
+	default:
+		return nil, fmt.Errorf("spool-overflow must be drop-oldest or drop-newest, got %q", cfg["spool-overflow"])
+	}
+
+	retry, err := parseDuration(cfg, "spool-retry-interval")
+	if err != nil {
+		return nil, err
+	}
+	if retry == 0 {
+		retry = defaultSpoolRetry
+	}
+
+	sp, err := openSpool(filepath.Join(stateDir(), "spool", info.ContainerID, name), maxSize, dropOldest)
+	if err != nil {
+		return nil, fmt.Errorf("error opening spool: %v", err)
+	}
+	sp.retry = retry
+	return sp, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+func spoolMessages(from, n int) []*logger.Message {
+	var msgs []*logger.Message
+	for i := from; i < from+n; i++ {
+		msgs = append(msgs, &logger.Message{Line: []byte(fmt.Sprintf("line %03d", i)), Source: "stdout", Timestamp: time.Unix(0, int64(i))})
+	}
+	return msgs
+}
+
+// TestSpoolAckDroppedSegment 发送期间读取的segment被drop-oldest删除后, ack不能把cursor移回已经删除的segment
+func TestSpoolAckDroppedSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openSpool(dir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	if err := s.append(spoolMessages(0, 2)); err != nil {
+		t.Fatal(err)
+	}
+	msgs, pos, err := s.read(spoolReplayBatch)
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("read %d records: %v", len(msgs), err)
+	}
+
+	// 写入更多的事件, 最早的segment被删除
+	next := 2
+	for s.segs[0].id <= pos.seg {
+		if err := s.append(spoolMessages(next, 1)); err != nil {
+			t.Fatal(err)
+		}
+		next++
+	}
+	if err := s.ack(pos, len(msgs)); err != nil {
+		t.Fatal(err)
+	}
+	if s.cursor != (spoolPos{seg: s.segs[0].id}) {
+		t.Fatalf("cursor %+v, want the start of segment %d", s.cursor, s.segs[0].id)
+	}
+
+	// 剩下的记录按顺序读出, 最后一条是最后写入的事件
+	var lines []string
+	for !s.empty() {
+		msgs, pos, err := s.read(spoolReplayBatch)
+		if err != nil || len(msgs) == 0 {
+			t.Fatalf("read %d records: %v", len(msgs), err)
+		}
+		for _, m := range msgs {
+			lines = append(lines, string(m.Line))
+		}
+		if err := s.ack(pos, len(msgs)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(lines) == 0 || lines[len(lines)-1] != fmt.Sprintf("line %03d", next-1) {
+		t.Errorf("replayed %v, want to end with line %03d", lines, next-1)
+	}
+	for i := 1; i < len(lines); i++ {
+		if lines[i] <= lines[i-1] {
+			t.Errorf("replayed out of order: %v", lines)
+			break
+		}
+	}
+}
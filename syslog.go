@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/daemon/logger/loggerutils"
+	"github.com/docker/go-connections/tlsconfig"
+)
+
+const (
+	syslogName           = "syslog"
+	defaultSyslogAddress = "unixgram:///dev/log"
+	defaultSyslogTimeout = 10 * time.Second
+	defaultSyslogRetry   = 1
+	syslogRetryInterval  = 100 * time.Millisecond
+
+	// syslogMaxAppName RFC 5424中APP-NAME的最大长度
+	syslogMaxAppName = 48
+
+	// syslogSDID 结构化数据的SD-ID, 32473为RFC 5612中保留给文档示例的企业编号
+	syslogSDID = "logchain@32473"
+
+	rfc5424MicroTime = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// syslogLogger 按照RFC 5424或者RFC 3164发送日志. tcp, tcp+tls和unix等流式连接使用RFC 6587的octet-counting分帧,
+// 所以合并后包含换行符的事件不会被服务端拆开
+type syslogLogger struct {
+	mu        sync.Mutex
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	framed    bool /*流式连接, 需要分帧*/
+	conn      net.Conn
+	format    string
+	facility  int
+	hostname  string
+	appName   string
+	pid       int
+	sd        string
+	retry     *retryPolicy
+}
+
+// NewSyslog creates a syslog logger. The supported log opts are syslog-address,
+// syslog-format, syslog-facility, syslog-max-retries, tag (the APP-NAME template)
+// and the syslog-tls-* options.
+func NewSyslog(info logger.Info) (logger.Logger, error) {
+	network, address, err := parseSyslogAddress(info.Config["syslog-address"])
+	if err != nil {
+		return nil, err
+	}
+
+	s := &syslogLogger{
+		network:  network,
+		address:  address,
+		framed:   network == "tcp" || network == "tcp+tls" || network == "unix",
+		facility: syslogFacilities["daemon"],
+		pid:      os.Getpid(),
+	}
+
+	switch info.Config["syslog-format"] {
+	case "", "rfc5424":
+		s.format = "rfc5424"
+	case "rfc5424micro", "rfc3164":
+		s.format = info.Config["syslog-format"]
+	default:
+		return nil, fmt.Errorf("syslog: unknown syslog-format %q", info.Config["syslog-format"])
+	}
+
+	if v, ok := info.Config["syslog-facility"]; ok {
+		if s.facility, err = parseSyslogFacility(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.hostname, err = info.Hostname(); err != nil {
+		return nil, fmt.Errorf("syslog: cannot access hostname: %v", err)
+	}
+
+	tag, err := loggerutils.ParseLogTag(info, loggerutils.DefaultTemplate)
+	if err != nil {
+		return nil, err
+	}
+	s.appName = syslogAppName(tag)
+
+	if s.retry, err = newRetryPolicy(info.Config, syslogName, defaultSyslogRetry, syslogRetryInterval); err != nil {
+		return nil, fmt.Errorf("syslog: %v", err)
+	}
+
+	s.sd = fmt.Sprintf(`%s container_id="%s" container_name="%s" image="%s"`, syslogSDID,
+		escapeSDParam(info.ContainerID), escapeSDParam(info.Name()), escapeSDParam(info.ContainerImageName))
+
+	if network == "tcp+tls" {
+		s.network = "tcp"
+		opts := tlsconfig.Options{
+			CAFile:   info.Config["syslog-tls-ca-cert"],
+			CertFile: info.Config["syslog-tls-cert"],
+			KeyFile:  info.Config["syslog-tls-key"],
+		}
+		if v, ok := info.Config["syslog-tls-skip-verify"]; ok {
+			if opts.InsecureSkipVerify, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("syslog: syslog-tls-skip-verify must be true or false")
+			}
+		}
+		if s.tlsConfig, err = tlsconfig.Client(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func parseSyslogAddress(address string) (string, string, error) {
+	if address == "" {
+		address = defaultSyslogAddress
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", fmt.Errorf("syslog: invalid syslog-address %q: %v", address, err)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp", "tcp+tls":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return "", "", fmt.Errorf("syslog: please provide syslog-address as %s://host:port", u.Scheme)
+		}
+		return u.Scheme, u.Host, nil
+	case "unix", "unixgram":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("syslog: please provide syslog-address as %s:///path/to/socket", u.Scheme)
+		}
+		return u.Scheme, u.Path, nil
+	default:
+		return "", "", fmt.Errorf("syslog: endpoint needs to be udp, tcp, tcp+tls, unix or unixgram, got %q", u.Scheme)
+	}
+}
+
+func parseSyslogFacility(facility string) (int, error) {
+	if f, ok := syslogFacilities[facility]; ok {
+		return f, nil
+	}
+	f, err := strconv.Atoi(facility)
+	if err != nil || f < 0 || f > 23 {
+		return 0, fmt.Errorf("syslog: invalid syslog-facility %q", facility)
+	}
+	return f, nil
+}
+
+// syslogAppName 将tag转换为APP-NAME: 只保留可打印的ASCII字符(PRINTUSASCII), 其它字符替换为_, 最长48个字符
+func syslogAppName(tag string) string {
+	b := make([]byte, 0, len(tag))
+	for _, r := range tag {
+		if len(b) == syslogMaxAppName {
+			break
+		}
+		if r < 33 || r > 126 {
+			r = '_'
+		}
+		b = append(b, byte(r))
+	}
+	if len(b) == 0 {
+		return "-"
+	}
+	return string(b)
+}
+
+// escapeSDParam 转义结构化数据中的", \和]
+func escapeSDParam(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(v)
+}
+
+func (s *syslogLogger) Log(msg *logger.Message) error {
+	data := s.message(msg)
+	logger.PutMessage(msg)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 连接可能已经被服务端关闭, 失败后重新连接再发送
+	return s.retry.do(syslogName, func() error {
+		if err := s.write(data); err != nil {
+			s.closeConn()
+			return fmt.Errorf("cannot send message to %s: %v", s.address, err)
+		}
+		return nil
+	})
+}
+
+// message 按照syslog-format生成完整的syslog消息
+func (s *syslogLogger) message(msg *logger.Message) []byte {
+	severity := 6 // info
+	if msg.Source == "stderr" {
+		severity = 3 // err
+	}
+	pri := s.facility*8 + severity
+
+	if s.format == "rfc3164" {
+		return []byte(fmt.Sprintf("<%d>%s %s %s[%d]: %s", pri,
+			msg.Timestamp.Format(time.Stamp), s.hostname, s.appName, s.pid, msg.Line))
+	}
+
+	timestamp := msg.Timestamp.Format(time.RFC3339)
+	if s.format == "rfc5424micro" {
+		timestamp = msg.Timestamp.Format(rfc5424MicroTime)
+	}
+
+	lineCount := msg.Attrs["line_count"]
+	if lineCount == "" {
+		lineCount = "1"
+	}
+
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d - [%s line_count=\"%s\"] %s", pri,
+		timestamp, s.hostname, s.appName, s.pid, s.sd, escapeSDParam(lineCount), msg.Line))
+}
+
+func (s *syslogLogger) write(data []byte) error {
+	if s.conn == nil {
+		var conn net.Conn
+		var err error
+		if s.tlsConfig != nil {
+			dialer := &net.Dialer{Timeout: defaultSyslogTimeout}
+			conn, err = tls.DialWithDialer(dialer, s.network, s.address, s.tlsConfig)
+		} else {
+			conn, err = net.DialTimeout(s.network, s.address, defaultSyslogTimeout)
+		}
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(defaultSyslogTimeout))
+	if s.framed {
+		// RFC 6587 octet-counting: MSG-LEN SP SYSLOG-MSG
+		data = append([]byte(strconv.Itoa(len(data))+" "), data...)
+	}
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *syslogLogger) closeConn() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *syslogLogger) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeConn()
+	return nil
+}
+
+func (s *syslogLogger) Name() string {
+	return syslogName
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+func TestSyslogAppName(t *testing.T) {
+	for tag, want := range map[string]string{
+		"web/nginx":             "web/nginx",
+		"my app\tv1":            "my_app_v1",
+		"":                      "-",
+		"容器":                    "__",
+		strings.Repeat("a", 60): strings.Repeat("a", 48),
+	} {
+		if got := syslogAppName(tag); got != want {
+			t.Errorf("syslogAppName(%q) = %q, want %q", tag, got, want)
+		}
+	}
+}
+
+// TestSyslogUnixFraming unix stream socket同样使用octet-counting, 多行事件作为一个消息
+func TestSyslogUnixFraming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		n, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(n))
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err == nil {
+			received <- string(b)
+		}
+	}()
+
+	s, err := NewSyslog(logger.Info{
+		ContainerID:   "0123456789abcdef0123456789abcdef",
+		ContainerName: "/web",
+		Config: map[string]string{
+			"syslog-address": "unix://" + path,
+			"tag":            "my app",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	m := logger.NewMessage()
+	m.Line = []byte("first\n\tsecond")
+	m.Timestamp = time.Now()
+	if err := s.Log(m); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		if !strings.HasSuffix(got, "first\n\tsecond") || !strings.Contains(got, " my_app ") {
+			t.Errorf("unexpected message %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+}
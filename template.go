@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// dateLayout 匹配模板中的日期格式, 例如logs-{{.ContainerName}}-2006.01.02中的2006.01.02
+var dateLayout = regexp.MustCompile(`2006([._-]?01)?([._-]?02)?`)
+
+// nameTemplate 由容器信息和日期组成的名称, 用于Elasticsearch的index, Kafka的topic, Splunk的host等.
+// 模板中可以使用{{.ContainerName}} {{.ContainerID}} {{.ID}} {{.ImageName}} {{.Hostname}}以及事件的时间{{.Time}}(UTC).
+// {{...}}之外的日期格式(例如2006.01.02)等同于{{.Time.Format "2006.01.02"}}
+type nameTemplate struct {
+	tmpl   *template.Template
+	data   nameData
+	static string /*不使用时间的模板预先生成的名称*/
+	dated  bool
+}
+
+// nameData 执行nameTemplate时的数据
+type nameData struct {
+	ContainerName string
+	ContainerID   string
+	ID            string
+	ImageName     string
+	Hostname      string
+	Time          time.Time
+}
+
+func newNameTemplate(text string, info logger.Info) (*nameTemplate, error) {
+	hostname, err := info.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	expanded := expandDateLayouts(text)
+	tmpl, err := template.New("name").Parse(expanded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %q: %v", text, err)
+	}
+
+	n := &nameTemplate{
+		tmpl: tmpl,
+		data: nameData{
+			ContainerName: info.Name(),
+			ContainerID:   info.ContainerID,
+			ID:            info.ID(),
+			ImageName:     info.ContainerImageName,
+			Hostname:      hostname,
+		},
+		dated: strings.Contains(expanded, ".Time"),
+	}
+	// 执行一次检查模板中的字段
+	name, err := n.execute(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %q: %v", text, err)
+	}
+	n.static = name
+	return n, nil
+}
+
+// Name 返回t时刻对应的名称. 执行失败的模板(例如对Time调用了错误的方法)返回空字符串
+func (n *nameTemplate) Name(t time.Time) string {
+	if !n.dated {
+		return n.static
+	}
+	name, _ := n.execute(t)
+	return name
+}
+
+func (n *nameTemplate) execute(t time.Time) (string, error) {
+	data := n.data
+	data.Time = t.UTC()
+	var b bytes.Buffer
+	if err := n.tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// expandDateLayouts 将{{...}}之外的日期格式替换为{{.Time.Format "<格式>"}}, {{...}}中的内容不变
+func expandDateLayouts(text string) string {
+	var b bytes.Buffer
+	for text != "" {
+		start := strings.Index(text, "{{")
+		if start < 0 {
+			start = len(text)
+		}
+		b.WriteString(dateLayout.ReplaceAllStringFunc(text[:start], func(layout string) string {
+			return "{{.Time.Format " + strconv.Quote(layout) + "}}"
+		}))
+		text = text[start:]
+		if text == "" {
+			break
+		}
+		end := actionEnd(text)
+		b.WriteString(text[:end])
+		text = text[end:]
+	}
+	return b.String()
+}
+
+// actionEnd 返回以{{开头的text中对应的}}之后的位置, 跳过字符串中的}}. 没有}}时返回len(text), 由Parse报告错误
+func actionEnd(text string) int {
+	var quote byte
+	for i := 2; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '`' || c == '\'':
+			quote = c
+		case c == '}' && strings.HasPrefix(text[i:], "}}"):
+			return i + 2
+		}
+	}
+	return len(text)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+func TestNameTemplate(t *testing.T) {
+	info := logger.Info{
+		ContainerID:        "0123456789abcdef0123456789abcdef",
+		ContainerName:      "/web",
+		ContainerImageName: "nginx",
+	}
+	ts := time.Date(2024, 3, 5, 23, 30, 0, 0, time.FixedZone("CST", 8*3600))
+	for text, want := range map[string]string{
+		"logs-{{.ContainerName}}-2006.01.02": "logs-web-2024.03.05",
+		"logs-2006-01":                       "logs-2024-03",
+		`{{if eq .ImageName "nginx"}}web-2006.01.02{{else}}other{{end}}`: "web-2024.03.05",
+		`{{printf "%s-2006" .ID}}`:                                       "0123456789ab-2006",
+		`{{.ContainerName}}-{{.Time.Format "20060102"}}`:                 "web-20240305",
+		`{{.ImageName}}`: "nginx",
+		`{{"}}"}}-2006`:  "}}-2024",
+	} {
+		n, err := newNameTemplate(text, info)
+		if err != nil {
+			t.Errorf("%s: %v", text, err)
+			continue
+		}
+		if got := n.Name(ts); got != want {
+			t.Errorf("%s: got %q, want %q", text, got, want)
+		}
+	}
+
+	for _, text := range []string{"{{.Unknown}}", "logs-{{if .ID}}", "{{.Time.Foo}}"} {
+		if _, err := newNameTemplate(text, info); err == nil {
+			t.Errorf("%s: invalid template accepted", text)
+		}
+	}
+}